@@ -5,10 +5,9 @@ import (
 	"log"
 	"net/http"
 
-	go_openai "github.com/sashabaranov/go-openai"
-
 	"github.com/zkiss/kb-codex/internal/app"
 	"github.com/zkiss/kb-codex/internal/config"
+	"github.com/zkiss/kb-codex/internal/llm"
 )
 
 func main() {
@@ -17,8 +16,11 @@ func main() {
 		log.Fatalf("could not load config: %v", err)
 	}
 
-	openaiClient := go_openai.NewClient(cfg.OpenAIAPIKey)
-	appInstance, err := app.New(cfg, openaiClient)
+	aiClient, err := llm.New(cfg)
+	if err != nil {
+		log.Fatalf("could not set up AI client: %v", err)
+	}
+	appInstance, err := app.New(cfg, aiClient)
 	if err != nil {
 		log.Fatalf("could not set up app: %v", err)
 	}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -20,6 +21,7 @@ import (
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/zkiss/kb-codex/internal/ai"
 	"github.com/zkiss/kb-codex/internal/app"
 	"github.com/zkiss/kb-codex/internal/config"
 	"github.com/zkiss/kb-codex/internal/handlers"
@@ -64,7 +66,10 @@ func setupApp(t *testing.T) *testApp {
 		t.Fatalf("conn string: %v", err)
 	}
 
-	ai := &fakeAI{emb: make([]float32, 1536)}
+	// A zero vector has no cosine distance, so give the fake embedding a direction.
+	emb := make([]float32, 1536)
+	emb[0] = 1
+	ai := &fakeAI{emb: emb}
 	appInstance, err := app.New(&config.Config{
 		DatabaseURL: dbURL,
 		JWTSecret:   []byte("test"),
@@ -206,6 +211,10 @@ func (f *fakeAI) CreateChatCompletion(ctx context.Context, req go_openai.ChatCom
 	return go_openai.ChatCompletionResponse{Choices: []go_openai.ChatCompletionChoice{{Message: go_openai.ChatCompletionMessage{Content: "ok"}}}}, nil
 }
 
+func (f *fakeAI) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	return nil, errors.New("streaming not supported")
+}
+
 func TestQnAAPI(t *testing.T) {
 	app := setupApp(t)
 
@@ -301,3 +310,72 @@ func TestCrossUserAccess(t *testing.T) {
 	resp3 := app.makeRequest(t, "GET", fmt.Sprintf("/api/kbs/%d/files", kb2.ID), user2, nil)
 	assert.Equal(t, http.StatusOK, resp3.StatusCode)
 }
+
+func TestCrossKBAsk(t *testing.T) {
+	app := setupApp(t)
+
+	user := app.createUserAndToken(t, "multi@example.com", "password")
+	runbooks := app.createKB(t, user, "runbooks")
+	hr := app.createKB(t, user, "hr")
+	app.uploadFile(t, runbooks, "restart.md", []byte("restart the server"))
+	app.uploadFile(t, hr, "leave.md", []byte("annual leave policy"))
+
+	body := strings.NewReader(fmt.Sprintf(`{"question":"hi","kb_ids":[%d,%d]}`, runbooks.ID, hr.ID))
+	resp := app.makeRequest(t, "POST", "/api/ask", user, body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var answer struct {
+		Answer string `json:"answer"`
+		Chunks []struct {
+			KBID   int64  `json:"kb_id"`
+			KBName string `json:"kb_name"`
+		} `json:"chunks"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&answer))
+	assert.Equal(t, "ok", answer.Answer)
+	kbNames := map[string]bool{}
+	for _, c := range answer.Chunks {
+		kbNames[c.KBName] = true
+	}
+	assert.Equal(t, map[string]bool{"runbooks": true, "hr": true}, kbNames)
+
+	resp = app.makeRequest(t, "POST", "/api/ask", user, strings.NewReader(`{"question":"hi","all_kbs":true}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	other := app.createUserAndToken(t, "other@example.com", "password")
+	otherKB := app.createKB(t, other, "private")
+	body = strings.NewReader(fmt.Sprintf(`{"question":"hi","kb_ids":[%d,%d]}`, runbooks.ID, otherKB.ID))
+	resp = app.makeRequest(t, "POST", "/api/ask", user, body)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "cannot include another user's KB")
+}
+
+func TestRoutedAsk(t *testing.T) {
+	app := setupApp(t)
+
+	user := app.createUserAndToken(t, "route@example.com", "password")
+	resp := app.makeRequest(t, "POST", "/api/ask", user, strings.NewReader(`{"question":"hi"}`))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "nothing to route to without KBs")
+
+	body := strings.NewReader(`{"name":"runbooks","description":"Operational runbooks for our services"}`)
+	resp = app.makeRequest(t, "POST", "/api/kbs", user, body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var kb handlers.KB
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&kb))
+	assert.Equal(t, "Operational runbooks for our services", kb.Description)
+	app.uploadFile(t, &testKB{ID: kb.ID, Name: kb.Name, User: user}, "restart.md", []byte("restart the server"))
+
+	resp = app.makeRequest(t, "POST", "/api/ask", user, strings.NewReader(`{"question":"hi"}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var answer struct {
+		Answer  string `json:"answer"`
+		Routing []struct {
+			KBID   int64  `json:"kb_id"`
+			Reason string `json:"reason"`
+		} `json:"routing"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&answer))
+	assert.Equal(t, "ok", answer.Answer)
+	if assert.Len(t, answer.Routing, 1) {
+		assert.Equal(t, kb.ID, answer.Routing[0].KBID)
+		assert.NotEmpty(t, answer.Routing[0].Reason)
+	}
+}
@@ -0,0 +1,46 @@
+// Package ai declares the client of the AI providers answering chat and
+// embedding requests. The handlers use it, the llm package builds it from the
+// configured providers, and test helpers fake it.
+package ai
+
+import (
+	"context"
+
+	go_openai "github.com/sashabaranov/go-openai"
+)
+
+// Client defines the subset of the OpenAI client used by the handlers. It
+// allows injecting a fake implementation in tests so no real network calls are
+// made.
+type Client interface {
+	CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error)
+	CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ChatStream, error)
+}
+
+// ChatStream is a chat completion streamed delta by delta. Recv returns io.EOF
+// once the completion is finished.
+type ChatStream interface {
+	Recv() (go_openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// openAIClient adapts the go-openai client to Client, whose streaming method
+// returns the ChatStream interface rather than a concrete type.
+type openAIClient struct {
+	*go_openai.Client
+}
+
+// NewOpenAIClient wraps a go-openai client as a Client.
+func NewOpenAIClient(c *go_openai.Client) Client {
+	return openAIClient{c}
+}
+
+// CreateChatCompletionStream implements Client.
+func (c openAIClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := c.Client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
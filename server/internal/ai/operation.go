@@ -0,0 +1,56 @@
+package ai
+
+import "context"
+
+// Operations AI requests are made for. Usage is recorded under them, and
+// clients that answer without a model, such as the local provider, pick their
+// reply by them instead of reading the prompt.
+const (
+	OpIndex     = "index"
+	OpSummarize = "summarize"
+	OpDescribe  = "describe"
+	OpProbe     = "probe"
+	OpQuery     = "query"
+	OpRewrite   = "rewrite"
+	OpRerank    = "rerank"
+	OpAnswer    = "answer"
+	OpVerify    = "verify"
+)
+
+type operationKey struct{}
+
+// WithOperation returns ctx marking the requests made with it as made for
+// operation.
+func WithOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+// OperationOf returns the operation requests made with ctx are for, or ""
+// when it is not known.
+func OperationOf(ctx context.Context) string {
+	op, _ := ctx.Value(operationKey{}).(string)
+	return op
+}
+
+// Inputs are the parts a chat prompt is built from.
+type Inputs struct {
+	Question string
+	// Passages are the context passages, numbered from 1 in the prompt.
+	Passages []string
+	// Claims are the sentences of an answer whose support is checked.
+	Claims []string
+}
+
+type inputsKey struct{}
+
+// WithInputs returns ctx carrying the inputs of the chat requests made with
+// it.
+func WithInputs(ctx context.Context, in Inputs) context.Context {
+	return context.WithValue(ctx, inputsKey{}, in)
+}
+
+// InputsOf returns the inputs of chat requests made with ctx, if any.
+func InputsOf(ctx context.Context) Inputs {
+	in, _ := ctx.Value(inputsKey{}).(Inputs)
+	return in
+}
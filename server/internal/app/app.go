@@ -2,11 +2,13 @@ package app
 
 import (
 	"database/sql"
+	"expvar"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/zkiss/kb-codex/internal/ai"
 	"github.com/zkiss/kb-codex/internal/config"
 	"github.com/zkiss/kb-codex/internal/db"
 	"github.com/zkiss/kb-codex/internal/handlers"
@@ -21,14 +23,56 @@ type App struct {
 }
 
 // New initializes the database, applies migrations and returns the App instance ready to be served.
-func New(cfg *config.Config, aiClient handlers.AIClient) (*App, error) {
+func New(cfg *config.Config, aiClient ai.Client) (*App, error) {
 	conn, err := db.ConnectAndMigrate(cfg.DatabaseURL)
 	if err != nil {
 		return nil, err
 	}
 
+	aiClient = handlers.RecordUsage(conn, aiClient, cfg.AIPrices)
+
 	authHandler := handlers.NewAuthHandler(conn, cfg.JWTSecret)
 	kbHandler := handlers.NewKBHandler(conn, aiClient)
+	kbHandler.Models = handlers.ModelOptions{
+		Chat:        cfg.ChatModel,
+		AllowedChat: cfg.ChatModels,
+		Embedding:   cfg.EmbeddingModel,
+	}
+	kbHandler.Reranker, err = handlers.NewReranker(cfg.Reranker, aiClient, cfg.ChatModel)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kbHandler.Grounding, err = handlers.NewGroundingChecker(cfg.GroundingCheck, aiClient, cfg.ChatModel)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kbHandler.Retrieval = handlers.RetrievalOptions{
+		Candidates:    cfg.RetrievalCandidates,
+		TopK:          cfg.RetrievalTopK,
+		MMRLambda:     cfg.MMRLambda,
+		Neighbours:    cfg.ContextNeighbours,
+		ContextTokens: cfg.ContextTokenBudget,
+		Mode:          cfg.RetrievalMode,
+		Documents:     cfg.RetrievalDocuments,
+		MinSimilarity: cfg.MinContextSimilarity,
+	}
+	kbHandler.Chunking = handlers.ChunkingOptions{
+		ChunkSize:   cfg.ChunkSize,
+		SectionSize: cfg.SectionSize,
+	}
+	kbHandler.Prompt = handlers.PromptOptions{
+		ContextWindow: cfg.ContextWindow,
+		AnswerTokens:  cfg.AnswerTokens,
+		HistoryTokens: cfg.HistoryTokenBudget,
+	}
+	kbHandler.SummarizeFiles = cfg.SummarizeFiles
+	kbHandler.Quota = cfg.Quota
+	kbHandler.AnswerCacheTTL = cfg.AnswerCacheTTL
+	kbHandler.AnswerWithoutContext = cfg.AnswerWithoutContext
+	adminHandler := handlers.NewAdminHandler(conn, cfg.AdminEmails)
+	adminHandler.Quota = kbHandler.Quota
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -44,10 +88,32 @@ func New(cfg *config.Config, aiClient handlers.AIClient) (*App, error) {
 		r.Use(utils.AuthMiddleware(cfg.JWTSecret))
 		r.Get("/api/kbs", kbHandler.ListKB)
 		r.Post("/api/kbs", kbHandler.CreateKB)
+		r.Patch("/api/kbs/{kbID}", kbHandler.UpdateKB)
 		r.Get("/api/kbs/{kbID}/files", kbHandler.ListFiles)
 		r.Get("/api/kbs/{kbID}/files/{slug}", kbHandler.GetFile)
 		r.Post("/api/kbs/{kbID}/files", kbHandler.UploadFile)
 		r.Post("/api/kbs/{kbID}/ask", kbHandler.AskQuestion)
+		r.Get("/api/kbs/{kbID}/conversations", kbHandler.ListConversations)
+		r.Post("/api/kbs/{kbID}/conversations", kbHandler.CreateConversation)
+		r.Get("/api/kbs/{kbID}/conversations/{conversationID}", kbHandler.GetConversation)
+		r.Delete("/api/kbs/{kbID}/conversations/{conversationID}", kbHandler.DeleteConversation)
+		r.Post("/api/kbs/{kbID}/answers/{answerID}/feedback", kbHandler.RateAnswer)
+		r.Get("/api/kbs/{kbID}/feedback", kbHandler.ListFeedback)
+		r.Post("/api/ask", kbHandler.AskAcross)
+		r.Get("/api/kbs/{kbID}/search", kbHandler.Search)
+		r.Post("/api/kbs/{kbID}/search", kbHandler.Search)
+		r.Get("/api/usage", kbHandler.Usage)
+	})
+
+	// Admin routes (authentication as one of ADMIN_EMAILS required)
+	r.Group(func(r chi.Router) {
+		r.Use(utils.AuthMiddleware(cfg.JWTSecret))
+		r.Use(adminHandler.RequireAdmin)
+		r.Get("/api/admin/users/{userID}/limits", adminHandler.GetUserLimits)
+		r.Put("/api/admin/users/{userID}/limits", adminHandler.SetUserLimits)
+		r.Put("/api/admin/kbs/{kbID}/limits", adminHandler.SetKBLimits)
+		// Counters and circuit states of the AI clients, among the runtime stats
+		r.Handle("/debug/vars", expvar.Handler())
 	})
 
 	r.Get("/index.html", func(w http.ResponseWriter, r *http.Request) {
@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds configuration settings for the application.
@@ -11,6 +14,144 @@ type Config struct {
 	DatabaseURL  string
 	JWTSecret    []byte
 	OpenAIAPIKey string
+
+	// ChatProvider and EmbeddingProvider select the backends answering chat
+	// and embedding requests.
+	ChatProvider      ProviderConfig
+	EmbeddingProvider ProviderConfig
+	// FallbackChatProvider answers chat requests while the chat provider is
+	// unavailable; its Kind is empty when there is none. FallbackChatModel,
+	// when set, replaces the requested model for it.
+	FallbackChatProvider ProviderConfig
+	FallbackChatModel    string
+
+	// AIMaxRetries is the number of retries of AI calls failing with rate
+	// limits or server errors, starting AIRetryDelay apart and doubling up to
+	// AIMaxRetryDelay. AICircuitThreshold consecutive failures stop calls to a
+	// provider for AICircuitCooldown.
+	AIMaxRetries       int
+	AIRetryDelay       time.Duration
+	AIMaxRetryDelay    time.Duration
+	AICircuitThreshold int
+	AICircuitCooldown  time.Duration
+	// AIPrices overrides the built-in prices of models, used to estimate the
+	// cost of AI calls.
+	AIPrices map[string]ModelPrice
+
+	// Quota holds the default monthly limits of every user; zero means
+	// unlimited. Admins may override them per user and set limits per KB.
+	Quota Quota
+	// AdminEmails lists the users allowed to adjust limits.
+	AdminEmails []string
+
+	// AnswerCacheTTL is how long answers are reused for repeated questions;
+	// zero disables the answer cache.
+	AnswerCacheTTL time.Duration
+
+	// ChatModel is the default chat model; ChatModels lists further chat
+	// models that knowledge bases and requests may choose.
+	ChatModel  string
+	ChatModels []string
+	// EmbeddingModel embeds the content of newly created knowledge bases.
+	EmbeddingModel string
+
+	// Reranker selects how retrieved chunks are reordered before answering:
+	// "none", "lexical" or "llm".
+	Reranker string
+	// RetrievalCandidates is the number of chunks fetched by vector search
+	// before reranking; RetrievalTopK how many of them reach the prompt.
+	RetrievalCandidates int
+	RetrievalTopK       int
+	// MMRLambda trades relevance (1) against diversity of the retrieved
+	// chunks (towards 0).
+	MMRLambda float64
+	// ContextNeighbours widens each retrieved chunk with this many adjacent
+	// chunks on either side.
+	ContextNeighbours int
+	// ContextTokenBudget bounds the size of the context put into the prompt.
+	ContextTokenBudget int
+	// ContextWindow is the token limit of the chat model, shared by the
+	// prompt and the answer.
+	ContextWindow int
+	// AnswerTokens is reserved in the context window for the answer.
+	AnswerTokens int
+	// HistoryTokenBudget bounds the conversation history sent to the model.
+	HistoryTokenBudget int
+
+	// ChunkSize is the size in characters of the embedded chunks and
+	// SectionSize of the parent sections handed to the model; zero
+	// SectionSize disables sections.
+	ChunkSize   int
+	SectionSize int
+
+	// SummarizeFiles generates a summary per uploaded file, by default only
+	// when RetrievalMode is "two_stage". RetrievalMode is "chunks" or
+	// "two_stage", the latter selecting RetrievalDocuments files by summary
+	// similarity before searching chunks.
+	SummarizeFiles     bool
+	RetrievalMode      string
+	RetrievalDocuments int
+
+	// MinContextSimilarity, when set, is the similarity below which chunks
+	// are not used as context. Questions without any chunk reaching it are
+	// answered as having no relevant context, by the chat model only when
+	// AnswerWithoutContext is set.
+	MinContextSimilarity *float64
+	AnswerWithoutContext bool
+	// GroundingCheck selects how answers are verified against their context:
+	// "none", "lexical" or "llm".
+	GroundingCheck string
+}
+
+// Provider kinds accepted by ProviderConfig.
+const (
+	ProviderOpenAI           = "openai"
+	ProviderAzure            = "azure"
+	ProviderOpenAICompatible = "openai_compatible"
+	// ProviderLocal answers offline with hashed embeddings and extractive
+	// answers, for development.
+	ProviderLocal = "local"
+)
+
+// defaultLocalDimensions is the embedding size of the local provider unless
+// configured otherwise.
+const defaultLocalDimensions = 256
+
+// ModelPrice is the price of a model in USD per million input and output
+// tokens.
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// Quota is a set of monthly limits on AI tokens, uploaded bytes and asked
+// questions, or the usage counted against them. A zero limit is unlimited.
+type Quota struct {
+	Tokens      int64 `json:"tokens"`
+	UploadBytes int64 `json:"upload_bytes"`
+	Questions   int64 `json:"questions"`
+}
+
+// defaultAzureAPIVersion is the Azure OpenAI api-version used unless
+// configured otherwise.
+const defaultAzureAPIVersion = "2024-06-01"
+
+// ProviderConfig describes an LLM backend.
+type ProviderConfig struct {
+	// Kind is ProviderOpenAI, ProviderAzure, ProviderOpenAICompatible or
+	// ProviderLocal.
+	Kind   string
+	APIKey string
+	// BaseURL is the Azure resource endpoint or the API root of an
+	// OpenAI-compatible server, e.g. http://localhost:11434/v1 for Ollama.
+	BaseURL string
+	// APIVersion is the Azure OpenAI api-version.
+	APIVersion string
+	// Deployments maps model names to Azure deployment names. Models without
+	// an entry are expected to be deployed under their own name.
+	Deployments map[string]string
+	// Dimensions is the embedding size of the local provider.
+	Dimensions int
 }
 
 // Load reads configuration from flags and environment variables.
@@ -31,13 +172,197 @@ func Load() (*Config, error) {
 	}
 
 	openAIKey := os.Getenv("OPENAI_API_KEY")
-	if openAIKey == "" {
-		return nil, fmt.Errorf("OPENAI_API_KEY environment variable is required but not set")
+	chatProvider, err := providerEnv([]string{"CHAT", "LLM"}, openAIKey)
+	if err != nil {
+		return nil, err
+	}
+	embeddingProvider, err := providerEnv([]string{"EMBEDDING", "LLM"}, openAIKey)
+	if err != nil {
+		return nil, err
+	}
+	var fallbackChatProvider ProviderConfig
+	if os.Getenv("FALLBACK_CHAT_PROVIDER") != "" {
+		fallbackChatProvider, err = providerEnv([]string{"FALLBACK_CHAT"}, openAIKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxRetries := 3
+	if v := os.Getenv("AI_MAX_RETRIES"); v != "" {
+		maxRetries, err = strconv.Atoi(v)
+		if err != nil || maxRetries < 0 {
+			return nil, fmt.Errorf("invalid AI_MAX_RETRIES value '%s': expected a non-negative integer", v)
+		}
+	}
+	retryDelay, err := durationEnv("AI_RETRY_DELAY", 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	maxRetryDelay, err := durationEnv("AI_MAX_RETRY_DELAY", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	circuitThreshold, err := intEnv("AI_CIRCUIT_THRESHOLD", 5)
+	if err != nil {
+		return nil, err
+	}
+	circuitCooldown, err := durationEnv("AI_CIRCUIT_COOLDOWN", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	prices, err := pricesEnv("AI_PRICES")
+	if err != nil {
+		return nil, err
+	}
+
+	var quota Quota
+	if quota.Tokens, err = limitEnv("QUOTA_TOKENS"); err != nil {
+		return nil, err
+	}
+	if quota.UploadBytes, err = limitEnv("QUOTA_UPLOAD_BYTES"); err != nil {
+		return nil, err
+	}
+	if quota.Questions, err = limitEnv("QUOTA_QUESTIONS"); err != nil {
+		return nil, err
+	}
+	answerCacheTTL := 24 * time.Hour
+	if v := os.Getenv("ANSWER_CACHE_TTL"); v != "" {
+		answerCacheTTL, err = time.ParseDuration(v)
+		if err != nil || answerCacheTTL < 0 {
+			return nil, fmt.Errorf("invalid ANSWER_CACHE_TTL value '%s': expected a duration such as 24h, or 0 to disable the cache", v)
+		}
+	}
+	var admins []string
+	for _, e := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			admins = append(admins, e)
+		}
+	}
+
+	chatModel := os.Getenv("CHAT_MODEL")
+	if chatModel == "" {
+		chatModel = "gpt-4o-mini"
+	}
+	var chatModels []string
+	for _, m := range strings.Split(os.Getenv("CHAT_MODELS"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			chatModels = append(chatModels, m)
+		}
+	}
+	embeddingModel := os.Getenv("EMBEDDING_MODEL")
+	if embeddingModel == "" {
+		embeddingModel = "text-embedding-3-small"
+		if embeddingProvider.Kind == ProviderLocal {
+			embeddingModel = ProviderLocal
+		}
+	}
+
+	reranker := os.Getenv("RERANKER")
+	if reranker == "" {
+		reranker = "none"
+	}
+
+	candidates, err := intEnv("RETRIEVAL_CANDIDATES", 50)
+	if err != nil {
+		return nil, err
+	}
+	topK, err := intEnv("RETRIEVAL_TOP_K", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbours := 0
+	if v := os.Getenv("CONTEXT_NEIGHBOURS"); v != "" {
+		neighbours, err = strconv.Atoi(v)
+		if err != nil || neighbours < 0 {
+			return nil, fmt.Errorf("invalid CONTEXT_NEIGHBOURS value '%s': expected a non-negative integer", v)
+		}
+	}
+
+	contextTokens, err := intEnv("CONTEXT_TOKEN_BUDGET", 3000)
+	if err != nil {
+		return nil, err
+	}
+	contextWindow, err := intEnv("CONTEXT_WINDOW_TOKENS", 16385)
+	if err != nil {
+		return nil, err
+	}
+	answerTokens, err := intEnv("ANSWER_TOKENS", 1024)
+	if err != nil {
+		return nil, err
+	}
+	if answerTokens >= contextWindow {
+		return nil, fmt.Errorf("ANSWER_TOKENS (%d) must be smaller than CONTEXT_WINDOW_TOKENS (%d)", answerTokens, contextWindow)
+	}
+	historyTokens, err := intEnv("HISTORY_TOKEN_BUDGET", 1000)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize, err := intEnv("CHUNK_SIZE", 1000)
+	if err != nil {
+		return nil, err
+	}
+	sectionSize := 0
+	if v := os.Getenv("SECTION_SIZE"); v != "" {
+		sectionSize, err = strconv.Atoi(v)
+		if err != nil || sectionSize < 0 {
+			return nil, fmt.Errorf("invalid SECTION_SIZE value '%s': expected a non-negative integer", v)
+		}
+	}
+
+	var minContextSimilarity *float64
+	if v := os.Getenv("MIN_CONTEXT_SIMILARITY"); v != "" {
+		s, err := strconv.ParseFloat(v, 64)
+		if err != nil || s < 0 {
+			return nil, fmt.Errorf("invalid MIN_CONTEXT_SIMILARITY value '%s': expected a non-negative number", v)
+		}
+		minContextSimilarity = &s
+	}
+	answerWithoutContext := false
+	if v := os.Getenv("ANSWER_WITHOUT_CONTEXT"); v != "" {
+		answerWithoutContext, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ANSWER_WITHOUT_CONTEXT value '%s': %v", v, err)
+		}
+	}
+	groundingCheck := os.Getenv("GROUNDING_CHECK")
+	if groundingCheck == "" {
+		groundingCheck = "none"
+	}
+	retrievalMode := os.Getenv("RETRIEVAL_MODE")
+	switch retrievalMode {
+	case "":
+		retrievalMode = "chunks"
+	case "chunks", "two_stage":
+	default:
+		return nil, fmt.Errorf("invalid RETRIEVAL_MODE value '%s': expected chunks or two_stage", retrievalMode)
+	}
+	// Summaries cost a chat completion per upload and only serve two-stage
+	// retrieval.
+	summarize := retrievalMode == "two_stage"
+	if v := os.Getenv("SUMMARIZE_FILES"); v != "" {
+		summarize, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SUMMARIZE_FILES value '%s': %v", v, err)
+		}
+	}
+	retrievalDocs, err := intEnv("RETRIEVAL_DOCUMENTS", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	mmrLambda := 0.7
+	if v := os.Getenv("MMR_LAMBDA"); v != "" {
+		mmrLambda, err = strconv.ParseFloat(v, 64)
+		if err != nil || mmrLambda <= 0 || mmrLambda > 1 {
+			return nil, fmt.Errorf("invalid MMR_LAMBDA value '%s': expected a number in (0, 1]", v)
+		}
 	}
 
 	// Convert port from string to uint16
 	var portUint uint16
-	_, err := fmt.Sscanf(port, "%d", &portUint)
+	_, err = fmt.Sscanf(port, "%d", &portUint)
 	if err != nil {
 		return nil, fmt.Errorf("invalid PORT value '%s': %v", port, err)
 	}
@@ -47,5 +372,190 @@ func Load() (*Config, error) {
 		DatabaseURL:  dbURL,
 		JWTSecret:    []byte(jwtSecret),
 		OpenAIAPIKey: openAIKey,
+
+		ChatProvider:         chatProvider,
+		EmbeddingProvider:    embeddingProvider,
+		FallbackChatProvider: fallbackChatProvider,
+		FallbackChatModel:    os.Getenv("FALLBACK_CHAT_MODEL"),
+
+		AIMaxRetries:       maxRetries,
+		AIRetryDelay:       retryDelay,
+		AIMaxRetryDelay:    maxRetryDelay,
+		AICircuitThreshold: circuitThreshold,
+		AICircuitCooldown:  circuitCooldown,
+		AIPrices:           prices,
+
+		Quota:       quota,
+		AdminEmails: admins,
+
+		AnswerCacheTTL: answerCacheTTL,
+
+		ChatModel:      chatModel,
+		ChatModels:     chatModels,
+		EmbeddingModel: embeddingModel,
+
+		Reranker:            reranker,
+		RetrievalCandidates: candidates,
+		RetrievalTopK:       topK,
+		MMRLambda:           mmrLambda,
+		ContextNeighbours:   neighbours,
+		ContextTokenBudget:  contextTokens,
+		ContextWindow:       contextWindow,
+		AnswerTokens:        answerTokens,
+		HistoryTokenBudget:  historyTokens,
+		ChunkSize:           chunkSize,
+		SectionSize:         sectionSize,
+		SummarizeFiles:      summarize,
+		RetrievalMode:       retrievalMode,
+		RetrievalDocuments:  retrievalDocs,
+
+		MinContextSimilarity: minContextSimilarity,
+		AnswerWithoutContext: answerWithoutContext,
+		GroundingCheck:       groundingCheck,
 	}, nil
 }
+
+// intEnv reads a positive integer environment variable, returning def when it
+// is not set.
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s value '%s': expected a positive integer", name, v)
+	}
+	return n, nil
+}
+
+// providerEnv reads a provider from the variables of the first of prefixes
+// that sets them, e.g. CHAT_PROVIDER before LLM_PROVIDER. The API key finally
+// falls back to openAIKey.
+func providerEnv(prefixes []string, openAIKey string) (ProviderConfig, error) {
+	role := prefixes[0]
+	get := func(name string) string {
+		for _, prefix := range prefixes {
+			if v := os.Getenv(prefix + "_" + name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	p := ProviderConfig{
+		Kind:       get("PROVIDER"),
+		APIKey:     get("API_KEY"),
+		BaseURL:    get("BASE_URL"),
+		APIVersion: get("API_VERSION"),
+	}
+	if p.Kind == "" {
+		p.Kind = ProviderOpenAI
+	}
+	if p.APIKey == "" {
+		p.APIKey = openAIKey
+	}
+	deployments := get("DEPLOYMENTS")
+	for _, pair := range strings.Split(deployments, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		model, deployment, ok := strings.Cut(pair, "=")
+		model, deployment = strings.TrimSpace(model), strings.TrimSpace(deployment)
+		if !ok || model == "" || deployment == "" {
+			return ProviderConfig{}, fmt.Errorf("invalid %s_DEPLOYMENTS value '%s': expected model=deployment pairs", role, deployments)
+		}
+		if p.Deployments == nil {
+			p.Deployments = map[string]string{}
+		}
+		p.Deployments[model] = deployment
+	}
+
+	switch p.Kind {
+	case ProviderOpenAI:
+		if p.APIKey == "" {
+			return ProviderConfig{}, fmt.Errorf("OPENAI_API_KEY environment variable is required but not set (or set %s_API_KEY)", role)
+		}
+	case ProviderAzure:
+		if p.BaseURL == "" || p.APIKey == "" {
+			return ProviderConfig{}, fmt.Errorf("the azure %s provider requires %s_BASE_URL and %s_API_KEY", strings.ToLower(role), role, role)
+		}
+		if p.APIVersion == "" {
+			p.APIVersion = defaultAzureAPIVersion
+		}
+	case ProviderOpenAICompatible:
+		if p.BaseURL == "" {
+			return ProviderConfig{}, fmt.Errorf("the openai_compatible %s provider requires %s_BASE_URL", strings.ToLower(role), role)
+		}
+	case ProviderLocal:
+		p.Dimensions = defaultLocalDimensions
+		if v := get("DIMENSIONS"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return ProviderConfig{}, fmt.Errorf("invalid %s_DIMENSIONS value '%s': expected a positive integer", role, v)
+			}
+			p.Dimensions = n
+		}
+	default:
+		return ProviderConfig{}, fmt.Errorf("invalid %s_PROVIDER value '%s': expected openai, azure, openai_compatible or local", role, p.Kind)
+	}
+	return p, nil
+}
+
+// limitEnv reads a non-negative limit from an environment variable, zero when
+// it is not set.
+func limitEnv(name string) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s value '%s': expected a non-negative integer", name, v)
+	}
+	return n, nil
+}
+
+// durationEnv reads a positive duration such as "500ms" from an environment
+// variable, returning def when it is not set.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s value '%s': expected a positive duration such as 500ms", name, v)
+	}
+	return d, nil
+}
+
+// pricesEnv reads model prices given as model=input/output pairs in USD per
+// million tokens, e.g. "gpt-4o-mini=0.15/0.60,text-embedding-3-small=0.02".
+// The output price may be left out.
+func pricesEnv(name string) (map[string]ModelPrice, error) {
+	v := os.Getenv(name)
+	prices := map[string]ModelPrice{}
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		invalid := fmt.Errorf("invalid %s value '%s': expected model=input/output prices per million tokens", name, v)
+		model, price, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(model) == "" {
+			return nil, invalid
+		}
+		in, out, hasOut := strings.Cut(price, "/")
+		var p ModelPrice
+		var err error
+		if p.Input, err = strconv.ParseFloat(strings.TrimSpace(in), 64); err != nil || p.Input < 0 {
+			return nil, invalid
+		}
+		if hasOut {
+			if p.Output, err = strconv.ParseFloat(strings.TrimSpace(out), 64); err != nil || p.Output < 0 {
+				return nil, invalid
+			}
+		}
+		prices[strings.TrimSpace(model)] = p
+	}
+	return prices, nil
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// AdminHandler provides endpoints for admins to inspect and adjust the
+// monthly limits of users and knowledge bases.
+type AdminHandler struct {
+	DB *sql.DB
+	// Admins lists the emails of the users allowed to use the endpoints.
+	Admins []string
+	// Quota holds the default monthly limits of every user.
+	Quota Quota
+}
+
+// NewAdminHandler constructs an AdminHandler instance.
+func NewAdminHandler(db *sql.DB, admins []string) *AdminHandler {
+	return &AdminHandler{DB: db, Admins: admins}
+}
+
+// RequireAdmin is middleware rejecting users that are not admins. It must run
+// after utils.AuthMiddleware.
+func (h *AdminHandler) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := utils.RequireUserID(r.Context())
+		if err != nil {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		var email string
+		err = h.DB.QueryRowContext(r.Context(), `SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		isAdmin := slices.ContainsFunc(h.Admins, func(a string) bool { return strings.EqualFold(a, email) })
+		if err == sql.ErrNoRows || !isAdmin {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// kbLimits reports the limits and usage of a knowledge base.
+type kbLimits struct {
+	KBID      int64          `json:"kb_id"`
+	Name      string         `json:"name"`
+	Overrides limitOverrides `json:"overrides"`
+	Used      Quota          `json:"used"`
+}
+
+// userLimits is the body of GET /api/admin/users/{userID}/limits. Limits are
+// the effective limits of the user, Overrides those set by an admin.
+type userLimits struct {
+	UserID    int64          `json:"user_id"`
+	Limits    Quota          `json:"limits"`
+	Overrides limitOverrides `json:"overrides"`
+	Used      Quota          `json:"used"`
+	ResetsAt  time.Time      `json:"resets_at"`
+	KBs       []kbLimits     `json:"kbs"`
+}
+
+// GetUserLimits handles GET /api/admin/users/{userID}/limits. It reports the
+// user's limits and this month's usage, for the user and each of their KBs.
+func (h *AdminHandler) GetUserLimits(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var exists int
+	err = h.DB.QueryRowContext(r.Context(), `SELECT 1 FROM users WHERE id = $1`, userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	since := monthStart(time.Now())
+	resp := userLimits{UserID: userID, ResetsAt: since.AddDate(0, 1, 0), KBs: []kbLimits{}}
+	if resp.Overrides, err = loadOverrides(r.Context(), h.DB, userQuota, userID); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	resp.Limits = resp.Overrides.apply(h.Quota)
+	if resp.Used, err = monthlyUsage(r.Context(), h.DB, userQuota, userID, since); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := h.DB.QueryContext(r.Context(), `SELECT id, name FROM knowledge_bases WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var kb kbLimits
+		if err := rows.Scan(&kb.KBID, &kb.Name); err != nil {
+			rows.Close()
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		resp.KBs = append(resp.KBs, kb)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	for i := range resp.KBs {
+		kb := &resp.KBs[i]
+		if kb.Overrides, err = loadOverrides(r.Context(), h.DB, kbQuota, kb.KBID); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if kb.Used, err = monthlyUsage(r.Context(), h.DB, kbQuota, kb.KBID, since); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SetUserLimits handles PUT /api/admin/users/{userID}/limits. The body sets
+// the user's limits; a null or missing limit falls back to the default and 0
+// means unlimited.
+func (h *AdminHandler) SetUserLimits(w http.ResponseWriter, r *http.Request) {
+	h.setLimits(w, r, userQuota, "userID", "users")
+}
+
+// SetKBLimits handles PUT /api/admin/kbs/{kbID}/limits. The body sets the
+// KB's limits; a null or missing limit removes it and 0 means unlimited.
+func (h *AdminHandler) SetKBLimits(w http.ResponseWriter, r *http.Request) {
+	h.setLimits(w, r, kbQuota, "kbID", "knowledge_bases")
+}
+
+// setLimits stores the limits of the user or KB named by the URL parameter
+// param, which must exist in table.
+func (h *AdminHandler) setLimits(w http.ResponseWriter, r *http.Request, scope quotaScope, param, table string) {
+	id, err := strconv.ParseInt(chi.URLParam(r, param), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+	var o limitOverrides
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+	for _, v := range []*int64{o.Tokens, o.UploadBytes, o.Questions} {
+		if v != nil && *v < 0 {
+			http.Error(w, "limits must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var exists int
+	err = h.DB.QueryRowContext(r.Context(), `SELECT 1 FROM `+table+` WHERE id = $1`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	_, err = h.DB.ExecContext(r.Context(),
+		`INSERT INTO `+scope.table+`(`+scope.column+`, tokens, upload_bytes, questions) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (`+scope.column+`) DO UPDATE SET tokens = EXCLUDED.tokens, upload_bytes = EXCLUDED.upload_bytes, questions = EXCLUDED.questions`,
+		id, o.Tokens, o.UploadBytes, o.Questions,
+	)
+	if err != nil {
+		http.Error(w, "could not save limits: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	h := NewAdminHandler(db, []string{"Admin@example.com"})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	mock.ExpectQuery("SELECT email FROM users").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("admin@example.com"))
+	w := httptest.NewRecorder()
+	h.RequireAdmin(next).ServeHTTP(w, conversationRequest(http.MethodGet, "", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	mock.ExpectQuery("SELECT email FROM users").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@example.com"))
+	w = httptest.NewRecorder()
+	h.RequireAdmin(next).ServeHTTP(w, conversationRequest(http.MethodGet, "", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetKBLimits(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1 FROM knowledge_bases").WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO kb_limits").WithArgs(int64(7), nil, nil, int64(50)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	h := NewAdminHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.SetKBLimits(w, conversationRequest(http.MethodPut, `{"questions": 50}`, map[string]string{"kbID": "7"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"tokens": null, "upload_bytes": null, "questions": 50}`, w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	w = httptest.NewRecorder()
+	h.SetKBLimits(w, conversationRequest(http.MethodPut, `{"tokens": -1}`, map[string]string{"kbID": "7"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// crossKBQuestionRequest represents a question asked across several knowledge
+// bases of the caller.
+type crossKBQuestionRequest struct {
+	questionRequest
+	KBIDs  []int64 `json:"kb_ids"`
+	AllKBs bool    `json:"all_kbs"`
+}
+
+// validateQuestionRequest checks the optional retrieval and model overrides of
+// a question, returning a message for the client when one is invalid.
+func (h *KBHandler) validateQuestionRequest(req questionRequest) string {
+	if req.MMRLambda != nil && (*req.MMRLambda <= 0 || *req.MMRLambda > 1) {
+		return "mmr_lambda must be greater than 0 and at most 1"
+	}
+	if req.Neighbours != nil && (*req.Neighbours < 0 || *req.Neighbours > maxNeighbours) {
+		return fmt.Sprintf("neighbours must be between 0 and %d", maxNeighbours)
+	}
+	if req.MinSimilarity != nil && *req.MinSimilarity < 0 {
+		return "min_similarity must not be negative"
+	}
+	if req.RetrievalMode != "" && req.RetrievalMode != RetrievalModeChunks && req.RetrievalMode != RetrievalModeTwoStage {
+		return "retrieval_mode must be chunks or two_stage"
+	}
+	if err := h.Models.validateChatModel(req.Model); err != nil {
+		return err.Error()
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > maxTemperature) {
+		return fmt.Sprintf("temperature must be between 0 and %d", maxTemperature)
+	}
+	if answerTokens := h.Prompt.withDefaults().AnswerTokens; req.MaxTokens != nil && (*req.MaxTokens < 1 || *req.MaxTokens > answerTokens) {
+		return fmt.Sprintf("max_tokens must be between 1 and %d", answerTokens)
+	}
+	return ""
+}
+
+// retrievalOptions applies the request's overrides to the configured options.
+func (req questionRequest) retrievalOptions(base RetrievalOptions) RetrievalOptions {
+	opts := base
+	if req.MMRLambda != nil {
+		opts.MMRLambda = *req.MMRLambda
+	}
+	if req.Neighbours != nil {
+		opts.Neighbours = *req.Neighbours
+	}
+	if req.RetrievalMode != "" {
+		opts.Mode = req.RetrievalMode
+	}
+	if req.MinSimilarity != nil {
+		opts.MinSimilarity = req.MinSimilarity
+	}
+	return opts.withDefaults()
+}
+
+// answer retrieves context for req from the given knowledge bases, asks the
+// chat model and writes the questionResponse, or streams it when the client
+// accepts text/event-stream. Ownership of every KB must have been checked by
+// the caller. With route set the question is instead routed to the most
+// relevant KBs of userID, and kbs must be nil; the quotas of the KBs picked
+// are checked before retrieval.
+func (h *KBHandler) answer(w http.ResponseWriter, r *http.Request, userID int64, kbs []kbSettings, route bool, req questionRequest) {
+	ctx := withAnswerUsage(r.Context(), kbs, "")
+	opts := req.retrievalOptions(h.Retrieval)
+	prompt := h.Prompt.withDefaults()
+	// Every chat model call of the answer uses the model answering it.
+	model := h.Models.chatModel(kbs, req.Model)
+	var err error
+	q := req.Question
+	history := trimHistory(req.History, prompt.HistoryTokens)
+	if len(history) > 0 {
+		q, err = rewriteQuestion(ctx, h.OpenAI, model, history, req.Question)
+		if err != nil {
+			http.Error(w, "question rewrite failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	emb := h.newQueryEmbedder(q)
+	var routes []kbRoute
+	if route {
+		if kbs, routes, err = h.routeQuestion(ctx, userID, emb); err != nil {
+			var embErr *embeddingError
+			if errors.As(err, &embErr) {
+				http.Error(w, embErr.Error(), http.StatusInternalServerError)
+			} else {
+				http.Error(w, "routing failed: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if len(kbs) == 0 {
+			http.Error(w, "no knowledge bases to answer from", http.StatusNotFound)
+			return
+		}
+		model = h.Models.chatModel(kbs, req.Model)
+	}
+	kbIDs := make([]int64, len(kbs))
+	for i, kb := range kbs {
+		kbIDs[i] = kb.ID
+	}
+	// The limits of routed KBs are only known to apply once they are picked.
+	if route && !h.checkQuota(w, r, userID, kbIDs, Quota{Questions: 1}) {
+		return
+	}
+	tmpl := promptFor(kbs)
+	values := promptValues{Question: req.Question, KBName: kbNames(kbs), Date: time.Now().Format("2006-01-02")}
+	contextBudget, err := prompt.contextBudget(tmpl, values, opts.ContextTokens)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Answers depending on earlier messages are not cached.
+	var cacheKey answerCacheKey
+	if h.AnswerCacheTTL > 0 && len(history) == 0 {
+		cacheKey = newAnswerCacheKey(kbs, req, opts, tmpl, values, model)
+		if !req.NoCache {
+			cached, ok, err := h.lookupAnswer(ctx, cacheKey)
+			if err != nil {
+				log.Printf("could not look up cached answer: %v", err)
+			} else if ok {
+				// A cached answer costs no tokens, but counts as a question.
+				insertUsage(withUsage(ctx, 0, opAnswer), h.DB, model, 0, 0, 0)
+				h.writeAnswer(w, r, kbIDs, req, questionResponse{
+					Answer:            cached.Answer,
+					Chunks:            cached.Chunks,
+					Citations:         cached.Citations,
+					Routing:           routes,
+					Cached:            true,
+					NoRelevantContext: cached.NoRelevantContext,
+					Grounding:         cached.Grounding,
+				})
+				return
+			}
+		}
+	}
+	chunks, err := h.retrieve(ctx, kbs, q, emb, opts, model)
+	if err != nil {
+		var embErr *embeddingError
+		if errors.As(err, &embErr) {
+			http.Error(w, embErr.Error(), http.StatusInternalServerError)
+		} else {
+			http.Error(w, "search failed: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	noContext := len(chunks) == 0
+	if noContext && !h.AnswerWithoutContext {
+		h.writeAnswer(w, r, kbIDs, req, questionResponse{
+			Answer:            noContextAnswer,
+			Chunks:            []questionChunk{},
+			Citations:         []citation{},
+			Routing:           routes,
+			NoRelevantContext: true,
+		})
+		return
+	}
+	passages, err := h.buildPassages(ctx, chunks, opts.Neighbours, contextBudget)
+	if err != nil {
+		http.Error(w, "search failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chunks = nil
+	for _, p := range passages {
+		chunks = append(chunks, p.Hits...)
+	}
+	values.Context = numberedContext(passages)
+
+	chatReq := go_openai.ChatCompletionRequest{
+		Model:     model,
+		Messages:  tmpl.messages(values),
+		MaxTokens: prompt.AnswerTokens,
+	}
+	if req.MaxTokens != nil {
+		chatReq.MaxTokens = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		chatReq.Temperature = apiTemperature(*req.Temperature)
+	}
+	texts := make([]string, len(passages))
+	for i, p := range passages {
+		texts[i] = p.Text
+	}
+	ctx = ai.WithInputs(withAnswerUsage(ctx, kbs, opAnswer), ai.Inputs{Question: req.Question, Passages: texts})
+	if wantsEventStream(r) {
+		h.streamAnswer(w, r.WithContext(ctx), kbIDs, chatReq, req, questionResponse{Chunks: chunks, Routing: routes, NoRelevantContext: noContext}, passages, cacheKey)
+		return
+	}
+	chatResp, err := h.OpenAI.CreateChatCompletion(ctx, chatReq)
+	if err != nil {
+		http.Error(w, "openai failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	answer := chatResp.Choices[0].Message.Content
+	citations := parseCitations(answer, passages)
+	grounding := h.checkGrounding(ctx, model, answer, passages)
+	if cacheKey.hash != "" {
+		cached := cachedAnswer{Answer: answer, Chunks: chunks, Citations: citations, NoRelevantContext: noContext, Grounding: grounding}
+		if err := h.storeAnswer(ctx, cacheKey, cached); err != nil {
+			log.Printf("could not cache answer: %v", err)
+		}
+	}
+	if req.ConversationID != 0 {
+		if err := h.saveExchange(ctx, req.ConversationID, req.Question, answer, citations); err != nil {
+			http.Error(w, "could not save conversation: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := questionResponse{
+		Answer:            answer,
+		Chunks:            chunks,
+		Citations:         citations,
+		Routing:           routes,
+		ConversationID:    req.ConversationID,
+		NoRelevantContext: noContext,
+		Grounding:         grounding,
+	}
+	resp.AnswerID = h.recordAnswer(ctx, kbIDs, req.Question, resp)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeAnswer writes an answer that was not generated for this request, like
+// a generated one: as JSON, or as Server-Sent Events with the whole answer in
+// a single "token" event. The exchange is stored when req continues a
+// conversation, and the answer is recorded for feedback on the KBs kbIDs.
+func (h *KBHandler) writeAnswer(w http.ResponseWriter, r *http.Request, kbIDs []int64, req questionRequest, resp questionResponse) {
+	ctx := r.Context()
+	resp.ConversationID = req.ConversationID
+	if !wantsEventStream(r) {
+		if req.ConversationID != 0 {
+			if err := h.saveExchange(ctx, req.ConversationID, req.Question, resp.Answer, resp.Citations); err != nil {
+				http.Error(w, "could not save conversation: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		resp.AnswerID = h.recordAnswer(ctx, kbIDs, req.Question, resp)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, "chunks", streamChunksEvent{Chunks: resp.Chunks, Routing: resp.Routing}); err != nil {
+		return
+	}
+	if err := writeEvent(w, "token", streamTokenEvent{Content: resp.Answer}); err != nil {
+		return
+	}
+	if req.ConversationID != 0 {
+		if err := h.saveExchange(ctx, req.ConversationID, req.Question, resp.Answer, resp.Citations); err != nil {
+			writeEvent(w, "error", streamErrorEvent{Error: "could not save conversation: " + err.Error()})
+			return
+		}
+	}
+	writeEvent(w, "done", streamDoneEvent{
+		Answer:            resp.Answer,
+		Citations:         resp.Citations,
+		ConversationID:    resp.ConversationID,
+		Cached:            resp.Cached,
+		NoRelevantContext: resp.NoRelevantContext,
+		Grounding:         resp.Grounding,
+		AnswerID:          h.recordAnswer(ctx, kbIDs, req.Question, resp),
+	})
+}
+
+// kbNames lists the names of the knowledge bases an answer is drawn from.
+func kbNames(kbs []kbSettings) string {
+	names := make([]string, len(kbs))
+	for i, kb := range kbs {
+		names[i] = kb.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// userKBIDs returns the IDs of all knowledge bases owned by a user.
+func (h *KBHandler) userKBIDs(r *http.Request, userID int64) ([]int64, error) {
+	rows, err := h.DB.QueryContext(r.Context(), `SELECT id FROM knowledge_bases WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// AskAcross handles POST /api/ask
+func (h *KBHandler) AskAcross(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	var req crossKBQuestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Question == "" {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if msg := h.validateQuestionRequest(req.questionRequest); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if req.ConversationID != 0 {
+		// Conversations belong to a single KB.
+		http.Error(w, "conversation_id is only supported when asking a single knowledge base", http.StatusBadRequest)
+		return
+	}
+
+	kbIDs := req.KBIDs
+	if req.AllKBs {
+		if kbIDs, err = h.userKBIDs(r, userID); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(kbIDs) == 0 {
+		if req.AllKBs {
+			http.Error(w, "no knowledge bases to answer from", http.StatusNotFound)
+			return
+		}
+		// No KBs named: route the question to the most relevant ones. The
+		// KBs' limits are checked once they are picked.
+		if !h.checkQuota(w, r, userID, nil, Quota{Questions: 1}) {
+			return
+		}
+		h.answer(w, r, userID, nil, true, req.questionRequest)
+		return
+	}
+
+	var kbs []kbSettings
+	seen := map[int64]bool{}
+	for _, kbID := range kbIDs {
+		if seen[kbID] {
+			continue
+		}
+		seen[kbID] = true
+		// Check KB ownership
+		if err := h.checkKBOwnership(kbID, userID); err != nil {
+			http.Error(w, fmt.Sprintf("kb %d: %v", kbID, err), http.StatusForbidden)
+			return
+		}
+		kb, err := h.loadKBSettings(r.Context(), kbID)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		kbs = append(kbs, kb)
+	}
+	ids := make([]int64, len(kbs))
+	for i, kb := range kbs {
+		ids[i] = kb.ID
+	}
+	if !h.checkQuota(w, r, userID, ids, Quota{Questions: 1}) {
+		return
+	}
+	h.answer(w, r, userID, kbs, false, req.questionRequest)
+}
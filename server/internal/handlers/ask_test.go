@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+// embedStubAI embeds every text as the same vector and answers chats like
+// chatStubAI.
+type embedStubAI struct {
+	chatStubAI
+}
+
+func (e *embedStubAI) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	return go_openai.EmbeddingResponse{Data: []go_openai.Embedding{{Embedding: []float32{1, 0}}}}, nil
+}
+
+func TestAnswerWithoutRelevantContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	ai := &embedStubAI{chatStubAI{reply: "made up"}}
+	h := NewKBHandler(db, ai)
+	minSimilarity := 0.5
+	h.Retrieval.MinSimilarity = &minSimilarity
+	kbs := []kbSettings{{ID: 7, DistanceMetric: DistanceCosine, EmbeddingModel: "e", EmbeddingDimensions: 2}}
+	columns := []string{"id", "file_name", "lookup_name", "chunk_index", "content", "section_id", "distance", "emb"}
+
+	// The threshold is applied by the search, which finds nothing close enough.
+	expectChunkSearch(mock, "50", sqlmock.NewRows(columns)).WithArgs(int64(7), sqlmock.AnyArg(), 0.5, 50, 0)
+	w := httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 1, kbs, false, questionRequest{Question: "what is the airspeed of a swallow?"})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp questionResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.True(t, resp.NoRelevantContext)
+	assert.Equal(t, noContextAnswer, resp.Answer)
+	assert.Empty(t, resp.Chunks)
+	assert.Zero(t, ai.calls, "the chat model is not asked")
+
+	// Optionally the model is asked anyway, without context.
+	h.AnswerWithoutContext = true
+	expectChunkSearch(mock, "50", sqlmock.NewRows(columns))
+	w = httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 1, kbs, false, questionRequest{Question: "what is the airspeed of a swallow?"})
+	resp = questionResponse{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.True(t, resp.NoRelevantContext)
+	assert.Equal(t, "made up", resp.Answer)
+	assert.Equal(t, 1, ai.calls)
+
+	// A lower min_similarity on the request lets a chunk through.
+	lower := 0.1
+	expectChunkSearch(mock, "50", sqlmock.NewRows(columns).AddRow(3, "a.md", "a-md", 0, "unrelated", 0, 0.8, "[0,1]")).
+		WithArgs(int64(7), sqlmock.AnyArg(), 0.1, 50, 0)
+	w = httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 1, kbs, false, questionRequest{Question: "what is the airspeed of a swallow?", MinSimilarity: &lower})
+	resp = questionResponse{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.False(t, resp.NoRelevantContext)
+	assert.Len(t, resp.Chunks, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAnswerRoutesToTheGivenUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// The user to route for is passed in, not taken from the request.
+	mock.ExpectQuery("FROM knowledge_bases WHERE user_id").WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	h := NewKBHandler(db, &embedStubAI{})
+	w := httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 5, nil, true, questionRequest{Question: "q"})
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAnswerChecksQuotaOfRoutedKBs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// The question is routed to KB 7, whose question limit is reached.
+	mock.ExpectQuery("FROM knowledge_bases WHERE user_id").WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "distance_metric", "system_prompt", "prompt_template",
+			"chat_model", "embedding_model", "embedding_dimensions", "content_version", "description_embedding"}).
+			AddRow(7, "kb", "", "cosine", "", "", "", "e", 2, 0, "[1,0]"))
+	expectChunkSearch(mock, "40", sqlmock.NewRows([]string{"id", "file_name", "lookup_name", "chunk_index", "content", "section_id", "distance", "emb"}))
+	mock.ExpectQuery("FROM user_limits").WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "upload_bytes", "questions"}))
+	mock.ExpectQuery("FROM kb_limits").WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "upload_bytes", "questions"}).AddRow(nil, nil, 2))
+	mock.ExpectQuery(`FROM ai_usage WHERE kb_ids @> ARRAY\[\$1::integer\]`).WithArgs(int64(7), sqlmock.AnyArg(), opAnswer).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "questions"}).AddRow(10, 2))
+	mock.ExpectQuery("FROM uploads").WithArgs(int64(7), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"bytes"}).AddRow(0))
+
+	ai := &embedStubAI{}
+	h := NewKBHandler(db, ai)
+	w := httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 5, nil, true, questionRequest{Question: "q"})
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	var body quotaExceeded
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, int64(7), body.KBID)
+	assert.Equal(t, "questions", body.Quota)
+	assert.Zero(t, ai.calls, "the chat model is not asked")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAnswerUsesTheKBModelThroughout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	ai := &embedStubAI{chatStubAI{reply: "Restart the database server [1]."}}
+	h := NewKBHandler(db, ai)
+	h.Reranker = &LLMReranker{AI: ai, Model: "default-model"}
+	h.Grounding = &LLMGroundingChecker{AI: ai, Model: "default-model"}
+	kbs := []kbSettings{{ID: 7, DistanceMetric: DistanceCosine, ChatModel: "kb-model", EmbeddingModel: "e", EmbeddingDimensions: 2}}
+	expectChunkSearch(mock, "50", sqlmock.NewRows([]string{"id", "file_name", "lookup_name", "chunk_index", "content", "section_id", "distance", "emb"}).
+		AddRow(3, "a.md", "a-md", 0, "Restart the database server from the console.", 0, 0.1, "[1,0]"))
+
+	w := httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 1, kbs, false, questionRequest{
+		Question: "and then?",
+		History:  []chatMessage{{Role: "user", Content: "how do I restart the database?"}, {Role: "assistant", Content: "From the console."}},
+	})
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	// The rewrite, the rerank, the answer and the grounding check.
+	assert.Equal(t, []string{"kb-model", "kb-model", "kb-model", "kb-model"}, ai.models)
+}
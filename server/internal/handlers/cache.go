@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	go_openai "github.com/sashabaranov/go-openai"
+)
+
+// answerCacheKey identifies a cached answer. The zero key marks a question
+// whose answer is not cached.
+type answerCacheKey struct {
+	hash string
+	// kbIDs are the KBs whose changes invalidate the answer.
+	kbIDs []int64
+}
+
+// normalizeQuestion folds the case, spacing and final punctuation of a
+// question, so that trivially different spellings share a cached answer.
+func normalizeQuestion(q string) string {
+	q = strings.Join(strings.Fields(strings.ToLower(q)), " ")
+	return strings.TrimRight(q, "?!. ")
+}
+
+// newAnswerCacheKey derives the cache key of an answer from everything it
+// depends on: the content version of each KB, the normalised question, the
+// chat model, the prompt filled with values but the context, and the
+// retrieval and answer options. The KB name and date thus only count when
+// the prompt uses them.
+func newAnswerCacheKey(kbs []kbSettings, req questionRequest, opts RetrievalOptions, tmpl promptTemplate, values promptValues, model string) answerCacheKey {
+	type kbVersion struct {
+		ID             int64
+		ContentVersion int64
+		DistanceMetric DistanceMetric
+	}
+	parts := struct {
+		KBs         []kbVersion
+		Question    string
+		Model       string
+		Prompt      []go_openai.ChatCompletionMessage
+		Retrieval   RetrievalOptions
+		Temperature *float32
+		MaxTokens   *int
+	}{
+		Question:    normalizeQuestion(req.Question),
+		Model:       model,
+		Prompt:      tmpl.messages(promptValues{Question: normalizeQuestion(req.Question), KBName: values.KBName, Date: values.Date}),
+		Retrieval:   opts,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+	}
+	key := answerCacheKey{}
+	for _, kb := range kbs {
+		parts.KBs = append(parts.KBs, kbVersion{ID: kb.ID, ContentVersion: kb.ContentVersion, DistanceMetric: kb.DistanceMetric})
+		key.kbIDs = append(key.kbIDs, kb.ID)
+	}
+	data, _ := json.Marshal(parts)
+	sum := sha256.Sum256(data)
+	key.hash = hex.EncodeToString(sum[:])
+	return key
+}
+
+// cachedAnswer is the part of a questionResponse kept in the answer cache.
+type cachedAnswer struct {
+	Answer    string          `json:"answer"`
+	Chunks    []questionChunk `json:"chunks"`
+	Citations []citation      `json:"citations"`
+	// NoRelevantContext is set for answers given without context.
+	NoRelevantContext bool             `json:"no_relevant_context,omitempty"`
+	Grounding         *groundingReport `json:"grounding,omitempty"`
+}
+
+// lookupAnswer returns the unexpired cached answer for key, if any.
+func (h *KBHandler) lookupAnswer(ctx context.Context, key answerCacheKey) (cachedAnswer, bool, error) {
+	var data []byte
+	err := h.DB.QueryRowContext(ctx,
+		`SELECT response FROM answer_cache WHERE key = $1 AND expires_at > $2`, key.hash, time.Now(),
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return cachedAnswer{}, false, nil
+	}
+	if err != nil {
+		return cachedAnswer{}, false, err
+	}
+	var a cachedAnswer
+	if err := json.Unmarshal(data, &a); err != nil {
+		return cachedAnswer{}, false, err
+	}
+	return a, true, nil
+}
+
+// storeAnswer caches an answer for AnswerCacheTTL, replacing any previous
+// answer for key, and drops expired answers.
+func (h *KBHandler) storeAnswer(ctx context.Context, key answerCacheKey, a cachedAnswer) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if _, err := h.DB.ExecContext(ctx, `DELETE FROM answer_cache WHERE expires_at <= $1`, now); err != nil {
+		return err
+	}
+	_, err = h.DB.ExecContext(ctx,
+		`INSERT INTO answer_cache(key, kb_ids, response, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key) DO UPDATE SET kb_ids = EXCLUDED.kb_ids, response = EXCLUDED.response, created_at = now(), expires_at = EXCLUDED.expires_at`,
+		key.hash, pq.Array(key.kbIDs), data, now.Add(h.AnswerCacheTTL),
+	)
+	return err
+}
+
+// contentChanged bumps the content version of a KB after its files changed
+// and drops the answers cached for it.
+func contentChanged(ctx context.Context, db execer, kbID int64) error {
+	if _, err := db.ExecContext(ctx, `UPDATE knowledge_bases SET content_version = content_version + 1 WHERE id = $1`, kbID); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM answer_cache WHERE $1 = ANY(kb_ids)`, kbID)
+	return err
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeQuestion(t *testing.T) {
+	assert.Equal(t, "how do i reset my password", normalizeQuestion("  How do I\treset my  password?? "))
+}
+
+func TestAnswerCacheKey(t *testing.T) {
+	kbs := []kbSettings{{ID: 7, ContentVersion: 3}}
+	opts := RetrievalOptions{}.withDefaults()
+	tmpl := promptFor(kbs)
+	values := promptValues{KBName: "Docs", Date: "2024-05-01"}
+	key := newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, tmpl, values, "m")
+
+	assert.Equal(t, key, newAnswerCacheKey(kbs, questionRequest{Question: "what is x"}, opts, tmpl, values, "m"))
+	assert.Equal(t, []int64{7}, key.kbIDs)
+	assert.NotEqual(t, key.hash, newAnswerCacheKey([]kbSettings{{ID: 7, ContentVersion: 4}}, questionRequest{Question: "What is X?"}, opts, tmpl, values, "m").hash)
+	assert.NotEqual(t, key.hash, newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, tmpl, values, "other").hash)
+	assert.NotEqual(t, key.hash, newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, promptTemplate{System: "s", User: "u"}, values, "m").hash)
+
+	// The KB name and date matter only to prompts using them.
+	renamed := promptValues{KBName: "Manuals", Date: "2024-05-02"}
+	assert.Equal(t, key, newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, tmpl, renamed, "m"))
+	named := promptTemplate{System: "You answer about {{kb_name}}.", User: tmpl.User}
+	assert.NotEqual(t, newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, named, values, "m").hash,
+		newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, named, renamed, "m").hash)
+	dated := promptTemplate{System: "Today is {{date}}.", User: tmpl.User}
+	assert.NotEqual(t, newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, dated, values, "m").hash,
+		newAnswerCacheKey(kbs, questionRequest{Question: "What is X?"}, opts, dated, renamed, "m").hash)
+}
+
+func TestAnswerFromCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	cached, _ := json.Marshal(cachedAnswer{Answer: "X is Y [1].", Citations: []citation{{Marker: 1, KBID: 7}}})
+	mock.ExpectQuery("SELECT response FROM answer_cache").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"response"}).AddRow(cached))
+	// The answer uses no tokens, but counts against the question quota.
+	mock.ExpectExec("INSERT INTO ai_usage").
+		WithArgs(int64(1), int64(7), "{7}", opAnswer, sqlmock.AnyArg(), 0, 0, 0.0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// No AI client: a cached answer needs neither an embedding nor a completion.
+	h := NewKBHandler(db, nil)
+	h.AnswerCacheTTL = time.Hour
+	w := httptest.NewRecorder()
+	h.answer(w, conversationRequest(http.MethodPost, "", nil), 1, []kbSettings{{ID: 7}}, false, questionRequest{Question: "What is X?"})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp questionResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.True(t, resp.Cached)
+	assert.Equal(t, "X is Y [1].", resp.Answer)
+	assert.Len(t, resp.Citations, 1)
+
+	// Streamed, the answer arrives as a single token.
+	mock.ExpectQuery("SELECT response FROM answer_cache").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"response"}).AddRow(cached))
+	mock.ExpectExec("INSERT INTO ai_usage").WillReturnResult(sqlmock.NewResult(1, 1))
+	w = httptest.NewRecorder()
+	r := conversationRequest(http.MethodPost, "", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.answer(w, r, 1, []kbSettings{{ID: 7}}, false, questionRequest{Question: "What is X?"})
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "event: token"))
+	assert.Contains(t, w.Body.String(), `"cached":true`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestContentChanged(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE knowledge_bases SET content_version = content_version \\+ 1").WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM answer_cache").WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	assert.NoError(t, contentChanged(context.Background(), db, 7))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// citation links a [n] marker in the answer to the passage it refers to.
+type citation struct {
+	Marker   int    `json:"marker"`
+	KBID     int64  `json:"kb_id"`
+	FileName string `json:"file_name"`
+	FileSlug string `json:"file_slug"`
+	// ChunkIndex and LastChunkIndex are the range of chunks the passage
+	// covers; they are equal for a single chunk.
+	ChunkIndex     int `json:"chunk_index"`
+	LastChunkIndex int `json:"last_chunk_index"`
+}
+
+// citationPattern matches markers such as [2] or [1, 3].
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// numberedContext labels each passage [1]..[n] so the model can cite it.
+func numberedContext(passages []contextPassage) string {
+	parts := make([]string, len(passages))
+	for i, p := range passages {
+		parts[i] = fmt.Sprintf("[%d] %s", i+1, p.Text)
+	}
+	return strings.Join(parts, "\n---\n")
+}
+
+// parseCitations returns the passages cited in answer, in order of their first
+// citation. Markers that do not refer to a passage are dropped.
+func parseCitations(answer string, passages []contextPassage) []citation {
+	citations := []citation{}
+	seen := map[int]bool{}
+	for _, m := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, field := range strings.Split(m[1], ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || n < 1 || n > len(passages) || seen[n] {
+				continue
+			}
+			seen[n] = true
+			p := passages[n-1]
+			citations = append(citations, citation{
+				Marker:         n,
+				KBID:           p.KBID,
+				FileName:       p.FileName,
+				FileSlug:       p.FileSlug,
+				ChunkIndex:     p.First,
+				LastChunkIndex: p.Last,
+			})
+		}
+	}
+	return citations
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func citationPassages() []contextPassage {
+	return []contextPassage{
+		{KBID: 1, FileName: "a.md", FileSlug: "a-md", First: 0, Last: 2, Text: "alpha"},
+		{KBID: 2, FileName: "b.md", FileSlug: "b-md", First: 4, Last: 4, Text: "bravo"},
+	}
+}
+
+func TestNumberedContext(t *testing.T) {
+	assert.Equal(t, "[1] alpha\n---\n[2] bravo", numberedContext(citationPassages()))
+}
+
+func TestParseCitations(t *testing.T) {
+	got := parseCitations("Bravo first [2]. Then both [1, 2], a bogus [7] and [0].", citationPassages())
+	assert.Equal(t, []citation{
+		{Marker: 2, KBID: 2, FileName: "b.md", FileSlug: "b-md", ChunkIndex: 4, LastChunkIndex: 4},
+		{Marker: 1, KBID: 1, FileName: "a.md", FileSlug: "a-md", ChunkIndex: 0, LastChunkIndex: 2},
+	}, got)
+}
+
+func TestParseCitationsNone(t *testing.T) {
+	assert.Equal(t, []citation{}, parseCitations("No sources [x].", citationPassages()))
+}
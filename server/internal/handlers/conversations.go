@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// conversationTitleLength bounds the title taken from a conversation's first
+// question when none was given.
+const conversationTitleLength = 60
+
+// errConversationNotFound is returned when a conversation does not exist in
+// the knowledge base it was requested for.
+var errConversationNotFound = errors.New("conversation not found")
+
+// conversation is a persisted question and answer thread about a KB.
+type conversation struct {
+	ID        int64                 `json:"id"`
+	KBID      int64                 `json:"kb_id"`
+	Title     string                `json:"title"`
+	CreatedAt time.Time             `json:"created_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+	Messages  []conversationMessage `json:"messages,omitempty"`
+}
+
+// conversationMessage is a question or an answer of a conversation. Answers
+// keep the citations they were given with.
+type conversationMessage struct {
+	ID        int64      `json:"id"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Citations []citation `json:"citations"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type createConversationRequest struct {
+	Title string `json:"title"`
+}
+
+// CreateConversation handles POST /api/kbs/{kbID}/conversations
+func (h *KBHandler) CreateConversation(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// The body is optional; an untitled conversation is named after its
+	// first question.
+	var req createConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	c := conversation{KBID: kbID, Title: req.Title}
+	err = h.DB.QueryRowContext(r.Context(),
+		`INSERT INTO conversations(kb_id, title) VALUES ($1, $2) RETURNING id, created_at, updated_at`,
+		kbID, req.Title,
+	).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		http.Error(w, "could not create conversation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// ListConversations handles GET /api/kbs/{kbID}/conversations
+func (h *KBHandler) ListConversations(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rows, err := h.DB.QueryContext(r.Context(),
+		`SELECT id, title, created_at, updated_at FROM conversations WHERE kb_id = $1 ORDER BY updated_at DESC, id DESC`,
+		kbID,
+	)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	conversations := []conversation{}
+	for rows.Next() {
+		c := conversation{KBID: kbID}
+		if err := rows.Scan(&c.ID, &c.Title, &c.CreatedAt, &c.UpdatedAt); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// GetConversation handles GET /api/kbs/{kbID}/conversations/{conversationID}
+func (h *KBHandler) GetConversation(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+	convID, err := strconv.ParseInt(chi.URLParam(r, "conversationID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	c := conversation{ID: convID, KBID: kbID}
+	err = h.DB.QueryRowContext(r.Context(),
+		`SELECT title, created_at, updated_at FROM conversations WHERE id = $1 AND kb_id = $2`,
+		convID, kbID,
+	).Scan(&c.Title, &c.CreatedAt, &c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, errConversationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if c.Messages, err = h.conversationMessages(r.Context(), convID); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// DeleteConversation handles DELETE /api/kbs/{kbID}/conversations/{conversationID}
+func (h *KBHandler) DeleteConversation(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+	convID, err := strconv.ParseInt(chi.URLParam(r, "conversationID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	res, err := h.DB.ExecContext(r.Context(), `DELETE FROM conversations WHERE id = $1 AND kb_id = $2`, convID, kbID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, errConversationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// conversationMessages returns the messages of a conversation, oldest first.
+func (h *KBHandler) conversationMessages(ctx context.Context, convID int64) ([]conversationMessage, error) {
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT id, role, content, citations, created_at FROM messages WHERE conversation_id = $1 ORDER BY id`,
+		convID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []conversationMessage{}
+	for rows.Next() {
+		var m conversationMessage
+		var citations []byte
+		if err := rows.Scan(&m.ID, &m.Role, &m.Content, &citations, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(citations, &m.Citations); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// conversationHistory loads a conversation of the KB as chat history for the
+// next question. It returns errConversationNotFound when the conversation
+// belongs to another KB or does not exist.
+func (h *KBHandler) conversationHistory(ctx context.Context, kbID, convID int64) ([]chatMessage, error) {
+	var exists int
+	err := h.DB.QueryRowContext(ctx, `SELECT 1 FROM conversations WHERE id = $1 AND kb_id = $2`, convID, kbID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, errConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	messages, err := h.conversationMessages(ctx, convID)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]chatMessage, len(messages))
+	for i, m := range messages {
+		history[i] = chatMessage{Role: m.Role, Content: m.Content}
+	}
+	return history, nil
+}
+
+// saveExchange appends a question and its answer to a conversation. An
+// untitled conversation is named after the question.
+func (h *KBHandler) saveExchange(ctx context.Context, convID int64, question, answer string, citations []citation) error {
+	cited, err := json.Marshal(citations)
+	if err != nil {
+		return err
+	}
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO messages(conversation_id, role, content) VALUES ($1, 'user', $2)`,
+		convID, question,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO messages(conversation_id, role, content, citations) VALUES ($1, 'assistant', $2, $3)`,
+		convID, answer, string(cited),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE conversations SET updated_at = now(), title = CASE WHEN title = '' THEN $2 ELSE title END WHERE id = $1`,
+		convID, utils.Snippet(question, conversationTitleLength),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// conversationRequest builds a request for user 1 with the given URL params.
+func conversationRequest(method, body string, params map[string]string) *http.Request {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	for k, v := range params {
+		rctx.URLParams.Add(k, v)
+	}
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, utils.UserIDKey, int64(1))
+	return req.WithContext(ctx)
+}
+
+func TestCreateConversation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT 1 FROM knowledge_bases").WithArgs(int64(7), int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("INSERT INTO conversations").WithArgs(int64(7), "").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, now, now))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.CreateConversation(w, conversationRequest(http.MethodPost, "", map[string]string{"kbID": "7"}))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var c conversation
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&c))
+	assert.Equal(t, int64(3), c.ID)
+	assert.Equal(t, int64(7), c.KBID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteConversationNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1 FROM knowledge_bases").
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectExec("DELETE FROM conversations").WithArgs(int64(9), int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.DeleteConversation(w, conversationRequest(http.MethodDelete, "", map[string]string{"kbID": "7", "conversationID": "9"}))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConversationHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT 1 FROM conversations").WithArgs(int64(9), int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("SELECT id, role, content, citations, created_at FROM messages").WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role", "content", "citations", "created_at"}).
+			AddRow(1, "user", "what is alpha?", []byte("[]"), now).
+			AddRow(2, "assistant", "the first letter [1]", []byte(`[{"marker":1,"file_slug":"a-md"}]`), now))
+
+	h := NewKBHandler(db, nil)
+	history, err := h.conversationHistory(context.Background(), 7, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, []chatMessage{
+		{Role: "user", Content: "what is alpha?"},
+		{Role: "assistant", Content: "the first letter [1]"},
+	}, history)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConversationHistoryOtherKB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1 FROM conversations").WithArgs(int64(9), int64(8)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+
+	h := NewKBHandler(db, nil)
+	_, err = h.conversationHistory(context.Background(), 8, 9)
+	assert.ErrorIs(t, err, errConversationNotFound)
+}
+
+func TestSaveExchange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO messages").WithArgs(int64(9), "what is alpha?").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO messages").
+		WithArgs(int64(9), "the first letter [1]", `[{"marker":1,"kb_id":7,"file_name":"a.md","file_slug":"a-md","chunk_index":0,"last_chunk_index":0}]`).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("UPDATE conversations").WithArgs(int64(9), "what is alpha?").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	h := NewKBHandler(db, nil)
+	cited := []citation{{Marker: 1, KBID: 7, FileName: "a.md", FileSlug: "a-md"}}
+	assert.NoError(t, h.saveExchange(context.Background(), 9, "what is alpha?", "the first letter [1]", cited))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
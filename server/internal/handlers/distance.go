@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DistanceMetric names the pgvector distance function used to compare the
+// embeddings of a knowledge base.
+type DistanceMetric string
+
+const (
+	DistanceL2           DistanceMetric = "l2"
+	DistanceCosine       DistanceMetric = "cosine"
+	DistanceInnerProduct DistanceMetric = "inner_product"
+)
+
+// DefaultDistanceMetric is used for knowledge bases created without an
+// explicit metric. OpenAI embeddings are normalised, so cosine distance is the
+// natural choice for them.
+const DefaultDistanceMetric = DistanceCosine
+
+// ParseDistanceMetric validates a metric name. An empty name selects
+// DefaultDistanceMetric.
+func ParseDistanceMetric(s string) (DistanceMetric, error) {
+	switch m := DistanceMetric(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return DefaultDistanceMetric, nil
+	case DistanceL2, DistanceCosine, DistanceInnerProduct:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported distance metric %q (expected l2, cosine or inner_product)", s)
+	}
+}
+
+// operator returns the pgvector operator computing the metric's distance.
+func (m DistanceMetric) operator() string {
+	switch m {
+	case DistanceCosine:
+		return "<=>"
+	case DistanceInnerProduct:
+		return "<#>"
+	default:
+		return "<->"
+	}
+}
+
+// opsClass returns the pgvector operator class an index must use so that it
+// can serve queries ordered by operator.
+func (m DistanceMetric) opsClass() string {
+	switch m {
+	case DistanceCosine:
+		return "vector_cosine_ops"
+	case DistanceInnerProduct:
+		return "vector_ip_ops"
+	default:
+		return "vector_l2_ops"
+	}
+}
+
+// similarity converts a distance returned by operator into a score where a
+// higher value means more similar. Cosine yields 1 - distance, inner product
+// the (un-negated) inner product and L2 maps the distance into (0, 1].
+func (m DistanceMetric) similarity(distance float64) float64 {
+	switch m {
+	case DistanceCosine:
+		return 1 - distance
+	case DistanceInnerProduct:
+		return -distance
+	default:
+		return 1 / (1 + distance)
+	}
+}
+
+// similaritySQL returns the SQL expression computing similarity from the given
+// distance expression, mirroring similarity.
+func (m DistanceMetric) similaritySQL(distance string) string {
+	switch m {
+	case DistanceCosine:
+		return "(1 - " + distance + ")"
+	case DistanceInnerProduct:
+		return "(-" + distance + ")"
+	default:
+		return "(1 / (1 + " + distance + "))"
+	}
+}
+
+// sanitizeDistance replaces the NaN pgvector returns for the cosine distance of
+// a zero vector with the largest possible cosine distance, so it sorts last
+// and can be encoded as JSON.
+func sanitizeDistance(d float64) float64 {
+	if math.IsNaN(d) {
+		return 2
+	}
+	return d
+}
+
+// vectorIndexName returns the name of the partial index serving the chunks of
+// a single knowledge base.
+func vectorIndexName(kbID int64) string {
+	return fmt.Sprintf("chunks_kb_%d_embedding_idx", kbID)
+}
+
+// indexedEmbedding returns the expression the vector index of a KB with the
+// given dimensions is built on. The embedding column has no fixed size, which
+// HNSW needs, so each index casts it to its KB's dimensions; searches must use
+// the same expression to be served by the index.
+func indexedEmbedding(dimensions int) string {
+	return fmt.Sprintf("(embedding::vector(%d))", dimensions)
+}
+
+// maxIndexedDimensions is the largest vector size pgvector can build an HNSW
+// index on.
+const maxIndexedDimensions = 2000
+
+// execer runs statements on a database or inside a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// checkIndexable reports an error when embeddings of the given size cannot be
+// indexed.
+func checkIndexable(model string, dimensions int) error {
+	if dimensions > maxIndexedDimensions {
+		return fmt.Errorf("embedding model %q has %d dimensions; at most %d can be indexed", model, dimensions, maxIndexedDimensions)
+	}
+	return nil
+}
+
+// ensureVectorIndex (re)creates the HNSW index over the chunks of a knowledge
+// base using the operator class that matches its distance metric. Each KB gets
+// its own partial index because the operator class and the dimensions differ
+// between KBs.
+func ensureVectorIndex(ctx context.Context, db execer, kbID int64, metric DistanceMetric, dimensions int) error {
+	name := vectorIndexName(kbID)
+	if _, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS `+name); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE INDEX %s ON chunks USING hnsw (%s %s) WHERE kb_id = %d`,
+		name, indexedEmbedding(dimensions), metric.opsClass(), kbID,
+	))
+	return err
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDistanceMetric(t *testing.T) {
+	m, err := ParseDistanceMetric("")
+	assert.NoError(t, err)
+	assert.Equal(t, DistanceCosine, m)
+
+	m, err = ParseDistanceMetric(" Inner_Product ")
+	assert.NoError(t, err)
+	assert.Equal(t, DistanceInnerProduct, m)
+
+	_, err = ParseDistanceMetric("manhattan")
+	assert.Error(t, err)
+}
+
+func TestDistanceMetricOperators(t *testing.T) {
+	assert.Equal(t, "<->", DistanceL2.operator())
+	assert.Equal(t, "<=>", DistanceCosine.operator())
+	assert.Equal(t, "<#>", DistanceInnerProduct.operator())
+
+	assert.Equal(t, "vector_l2_ops", DistanceL2.opsClass())
+	assert.Equal(t, "vector_cosine_ops", DistanceCosine.opsClass())
+	assert.Equal(t, "vector_ip_ops", DistanceInnerProduct.opsClass())
+}
+
+func TestDistanceMetricSimilarity(t *testing.T) {
+	assert.InDelta(t, 0.75, DistanceCosine.similarity(0.25), 1e-9)
+	assert.InDelta(t, 0.8, DistanceInnerProduct.similarity(-0.8), 1e-9)
+	assert.InDelta(t, 0.5, DistanceL2.similarity(1), 1e-9)
+	assert.Equal(t, 2.0, sanitizeDistance(math.NaN()))
+}
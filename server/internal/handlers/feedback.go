@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	ratingUp   = "up"
+	ratingDown = "down"
+
+	defaultFeedbackLimit = 50
+	maxFeedbackLimit     = 200
+	// maxFeedbackComment bounds the free-text comment of a rating, in bytes.
+	maxFeedbackComment = 4000
+)
+
+// chunkRef identifies a chunk an answer was based on, and where the file API
+// finds it.
+type chunkRef struct {
+	ID       int64  `json:"id"`
+	KBID     int64  `json:"kb_id"`
+	FileSlug string `json:"file_slug"`
+	Index    int    `json:"index"`
+}
+
+// recordAnswer stores an answer from the KBs kbIDs given to the current user
+// so that it can be rated, returning its ID. Answers are recorded on a
+// best-effort basis: when that fails, or there is no user, it returns 0 and
+// the answer goes out without an ID.
+func (h *KBHandler) recordAnswer(ctx context.Context, kbIDs []int64, question string, resp questionResponse) int64 {
+	userID, ok := utils.GetUserID(ctx)
+	if !ok || len(kbIDs) == 0 {
+		return 0
+	}
+	chunkIDs := make([]int64, len(resp.Chunks))
+	for i, c := range resp.Chunks {
+		chunkIDs[i] = c.ID
+	}
+	citations := resp.Citations
+	if citations == nil {
+		citations = []citation{}
+	}
+	cited, err := json.Marshal(citations)
+	if err != nil {
+		log.Printf("could not record answer: %v", err)
+		return 0
+	}
+	var id int64
+	err = h.DB.QueryRowContext(ctx,
+		`INSERT INTO answers(user_id, kb_ids, question, answer, chunk_ids, citations) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		userID, pq.Array(kbIDs), question, resp.Answer, pq.Array(chunkIDs), string(cited),
+	).Scan(&id)
+	if err != nil {
+		log.Printf("could not record answer: %v", err)
+		return 0
+	}
+	return id
+}
+
+type feedbackRequest struct {
+	// Rating is "up" or "down".
+	Rating  string `json:"rating"`
+	Comment string `json:"comment"`
+	// HelpfulCitations are the markers of the answer's citations that helped.
+	HelpfulCitations []int `json:"helpful_citations"`
+}
+
+// feedback is a user's rating of an answer, listed with the answer it rates.
+type feedback struct {
+	ID               int64     `json:"id"`
+	AnswerID         int64     `json:"answer_id"`
+	Rating           string    `json:"rating"`
+	Comment          string    `json:"comment"`
+	HelpfulCitations []int     `json:"helpful_citations"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+
+	Question  string     `json:"question,omitempty"`
+	Answer    string     `json:"answer,omitempty"`
+	Chunks    []chunkRef `json:"chunks,omitempty"`
+	Citations []citation `json:"citations,omitempty"`
+}
+
+// validate checks a rating against the citations of the rated answer,
+// returning a message for the client when it is invalid.
+func (req feedbackRequest) validate(citations []citation) string {
+	if req.Rating != ratingUp && req.Rating != ratingDown {
+		return "rating must be up or down"
+	}
+	if len(req.Comment) > maxFeedbackComment {
+		return fmt.Sprintf("comment must be at most %d bytes", maxFeedbackComment)
+	}
+	cited := map[int]bool{}
+	for _, c := range citations {
+		cited[c.Marker] = true
+	}
+	for _, m := range req.HelpfulCitations {
+		if !cited[m] {
+			return fmt.Sprintf("helpful_citations: the answer has no citation [%d]", m)
+		}
+	}
+	return ""
+}
+
+// RateAnswer handles POST /api/kbs/{kbID}/answers/{answerID}/feedback. Rating
+// an answer again replaces the earlier rating.
+func (h *KBHandler) RateAnswer(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+	answerID, err := strconv.ParseInt(chi.URLParam(r, "answerID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid answer ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req feedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var cited []byte
+	err = h.DB.QueryRowContext(r.Context(),
+		`SELECT citations FROM answers WHERE id = $1 AND $2 = ANY(kb_ids)`, answerID, kbID,
+	).Scan(&cited)
+	if err == sql.ErrNoRows {
+		http.Error(w, "answer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	var citations []citation
+	if err := json.Unmarshal(cited, &citations); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if msg := req.validate(citations); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	f := feedback{AnswerID: answerID, Rating: req.Rating, Comment: req.Comment, HelpfulCitations: req.HelpfulCitations}
+	if f.HelpfulCitations == nil {
+		f.HelpfulCitations = []int{}
+	}
+	err = h.DB.QueryRowContext(r.Context(),
+		`INSERT INTO answer_feedback(answer_id, kb_id, user_id, rating, comment, helpful_citations) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (answer_id, user_id) DO UPDATE SET kb_id = EXCLUDED.kb_id, rating = EXCLUDED.rating, comment = EXCLUDED.comment,
+			helpful_citations = EXCLUDED.helpful_citations, updated_at = now()
+		RETURNING id, created_at, updated_at`,
+		answerID, kbID, userID, req.Rating, req.Comment, pq.Array(f.HelpfulCitations),
+	).Scan(&f.ID, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		http.Error(w, "could not save feedback: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// ListFeedback handles GET /api/kbs/{kbID}/feedback. It lists the ratings of
+// the KB's answers, newest first, with the question, answer and chunks each
+// rates; chunks deleted since, e.g. by uploading their file again, are left
+// out. Only negative ratings are listed unless rating=up or rating=all is
+// given; limit (default 50, at most 200) and offset page through them.
+func (h *KBHandler) ListFeedback(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	ratings := []string{ratingDown}
+	switch q.Get("rating") {
+	case "", ratingDown:
+	case ratingUp:
+		ratings = []string{ratingUp}
+	case "all":
+		ratings = []string{ratingUp, ratingDown}
+	default:
+		http.Error(w, "rating must be up, down or all", http.StatusBadRequest)
+		return
+	}
+	limit, offset := defaultFeedbackLimit, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxFeedbackLimit {
+		limit = maxFeedbackLimit
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rows, err := h.DB.QueryContext(r.Context(),
+		`SELECT f.id, f.answer_id, f.rating, f.comment, f.helpful_citations, f.created_at, f.updated_at,
+			a.question, a.answer, a.citations,
+			COALESCE((SELECT json_agg(json_build_object('id', c.id, 'kb_id', c.kb_id, 'file_slug', c.lookup_name, 'index', c.chunk_index)
+				ORDER BY array_position(a.chunk_ids, c.id)) FROM chunks c WHERE c.id = ANY(a.chunk_ids)), '[]')
+		FROM answer_feedback f JOIN answers a ON a.id = f.answer_id
+		WHERE f.kb_id = $1 AND f.rating = ANY($2)
+		ORDER BY f.updated_at DESC, f.id DESC
+		LIMIT $3 OFFSET $4`,
+		kbID, pq.Array(ratings), limit, offset,
+	)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []feedback{}
+	for rows.Next() {
+		var f feedback
+		var helpful pq.Int64Array
+		var chunks, citations []byte
+		if err := rows.Scan(&f.ID, &f.AnswerID, &f.Rating, &f.Comment, &helpful, &f.CreatedAt, &f.UpdatedAt,
+			&f.Question, &f.Answer, &citations, &chunks); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		f.HelpfulCitations = make([]int, len(helpful))
+		for i, m := range helpful {
+			f.HelpfulCitations[i] = int(m)
+		}
+		if err := json.Unmarshal(chunks, &f.Chunks); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(citations, &f.Citations); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		list = append(list, f)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteAnswerRecordsAnswer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("INSERT INTO answers").
+		WithArgs(int64(1), "{7}", "what is x?", "X is Y [1].", "{12}", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.writeAnswer(w, conversationRequest(http.MethodPost, "", nil), []int64{7}, questionRequest{Question: "what is x?"}, questionResponse{
+		Answer:    "X is Y [1].",
+		Chunks:    []questionChunk{{ID: 12, KBID: 7, FileSlug: "a-md", Index: 2}},
+		Citations: []citation{{Marker: 1, KBID: 7}},
+	})
+
+	var resp questionResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, int64(42), resp.AnswerID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRateAnswer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT 1 FROM knowledge_bases").WithArgs(int64(7), int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("SELECT citations FROM answers").WithArgs(int64(42), int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"citations"}).AddRow(`[{"marker":1,"kb_id":7},{"marker":2,"kb_id":7}]`))
+	mock.ExpectQuery("INSERT INTO answer_feedback").
+		WithArgs(int64(42), int64(7), int64(1), ratingDown, "outdated", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(5, now, now))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.RateAnswer(w, conversationRequest(http.MethodPost, `{"rating":"down","comment":"outdated","helpful_citations":[2]}`,
+		map[string]string{"kbID": "7", "answerID": "42"}))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var f feedback
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&f))
+	assert.Equal(t, int64(5), f.ID)
+	assert.Equal(t, []int{2}, f.HelpfulCitations)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRateAnswerInvalid(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	h := NewKBHandler(db, nil)
+	params := map[string]string{"kbID": "7", "answerID": "42"}
+	cases := []struct {
+		body string
+		code int
+	}{
+		{`{"rating":"meh"}`, http.StatusBadRequest},
+		{`{"rating":"up","helpful_citations":[3]}`, http.StatusBadRequest},
+		{`{"rating":"up"}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		mock.ExpectQuery("SELECT 1 FROM knowledge_bases").
+			WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+		if c.code == http.StatusNotFound {
+			mock.ExpectQuery("SELECT citations FROM answers").WillReturnRows(sqlmock.NewRows([]string{"citations"}))
+		} else {
+			mock.ExpectQuery("SELECT citations FROM answers").
+				WillReturnRows(sqlmock.NewRows([]string{"citations"}).AddRow(`[{"marker":1,"kb_id":7}]`))
+		}
+		w := httptest.NewRecorder()
+		h.RateAnswer(w, conversationRequest(http.MethodPost, c.body, params))
+		assert.Equal(t, c.code, w.Code, c.body)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListFeedback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT 1 FROM knowledge_bases").WithArgs(int64(7), int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("FROM answer_feedback f JOIN answers a").
+		WithArgs(int64(7), sqlmock.AnyArg(), defaultFeedbackLimit, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "answer_id", "rating", "comment", "helpful_citations", "created_at", "updated_at", "question", "answer", "citations", "chunks"}).
+			AddRow(5, 42, ratingDown, "outdated", "{2}", now, now, "what is x?", "X is Y [1].", `[{"marker":1,"kb_id":7}]`, `[{"id":12,"kb_id":7,"file_slug":"a-md","index":2}]`))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.ListFeedback(w, conversationRequest(http.MethodGet, "", map[string]string{"kbID": "7"}))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list []feedback
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, int64(42), list[0].AnswerID)
+		assert.Equal(t, []int{2}, list[0].HelpfulCitations)
+		assert.Equal(t, "what is x?", list[0].Question)
+		assert.Equal(t, []chunkRef{{ID: 12, KBID: 7, FileSlug: "a-md", Index: 2}}, list[0].Chunks)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	// minClaimTerms is the number of terms a sentence needs to count as a
+	// claim; shorter ones such as "Yes." are not checked.
+	minClaimTerms = 3
+	// lexicalSupport is the share of a claim's terms a single passage must
+	// contain for the lexical check to consider the claim supported.
+	lexicalSupport = 0.6
+)
+
+// groundingReport tells how well an answer is supported by its context.
+type groundingReport struct {
+	// Score is the share of the answer's claims supported by the context,
+	// from 0 to 1.
+	Score float64 `json:"score"`
+	// Unsupported lists the sentences of the answer the context does not
+	// support.
+	Unsupported []string `json:"unsupported"`
+	// Method is the check that produced the report, "llm" or "lexical".
+	Method string `json:"method"`
+}
+
+// GroundingChecker verifies the claims of an answer against the context
+// passages it was generated from. model is the chat model that wrote the
+// answer, which checks asking a chat model use.
+type GroundingChecker interface {
+	Check(ctx context.Context, model, answer string, passages []contextPassage) (*groundingReport, error)
+}
+
+// NewGroundingChecker returns the grounding check registered under name:
+// "llm" has the given chat model judge each claim and falls back to "lexical"
+// (term overlap) when the model call fails. An empty name or "none" disables
+// the check.
+func NewGroundingChecker(name string, client AIClient, model string) (GroundingChecker, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return nil, nil
+	case "lexical":
+		return LexicalGroundingChecker{}, nil
+	case "llm":
+		return &LLMGroundingChecker{AI: client, Model: model, Fallback: LexicalGroundingChecker{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown grounding check %q (expected none, lexical or llm)", name)
+	}
+}
+
+// splitClaims splits an answer into the sentences worth checking.
+func splitClaims(answer string) []string {
+	var claims []string
+	for _, s := range utils.Sentences(answer) {
+		if len(claimTerms(s)) >= minClaimTerms {
+			claims = append(claims, s)
+		}
+	}
+	return claims
+}
+
+// claimTerms returns the terms of a claim without its citation markers.
+func claimTerms(claim string) []string {
+	return utils.Tokenize(citationPattern.ReplaceAllString(claim, " "))
+}
+
+// newGroundingReport scores claims by their verdicts.
+func newGroundingReport(method string, claims []string, supported []bool) *groundingReport {
+	report := &groundingReport{Score: 1, Unsupported: []string{}, Method: method}
+	if len(claims) == 0 {
+		return report
+	}
+	n := 0
+	for i, claim := range claims {
+		if supported[i] {
+			n++
+		} else {
+			report.Unsupported = append(report.Unsupported, claim)
+		}
+	}
+	report.Score = float64(n) / float64(len(claims))
+	return report
+}
+
+// LexicalGroundingChecker considers a claim supported when a single passage
+// contains most of its terms.
+type LexicalGroundingChecker struct{}
+
+// Check implements GroundingChecker.
+func (LexicalGroundingChecker) Check(_ context.Context, _, answer string, passages []contextPassage) (*groundingReport, error) {
+	passageTerms := make([]map[string]bool, len(passages))
+	for i, p := range passages {
+		passageTerms[i] = map[string]bool{}
+		for _, t := range utils.Tokenize(p.Text) {
+			passageTerms[i][t] = true
+		}
+	}
+	claims := splitClaims(answer)
+	supported := make([]bool, len(claims))
+	for i, claim := range claims {
+		terms := map[string]bool{}
+		for _, t := range claimTerms(claim) {
+			terms[t] = true
+		}
+		for _, pt := range passageTerms {
+			found := 0
+			for t := range terms {
+				if pt[t] {
+					found++
+				}
+			}
+			if float64(found) >= lexicalSupport*float64(len(terms)) {
+				supported[i] = true
+				break
+			}
+		}
+	}
+	return newGroundingReport("lexical", claims, supported), nil
+}
+
+// LLMGroundingChecker asks the chat model whether the passages support each
+// claim. When the call fails or the reply cannot be parsed the Fallback check
+// is used.
+type LLMGroundingChecker struct {
+	AI AIClient
+	// Model is the chat model judging the claims when Check is given none;
+	// empty selects the default chat model.
+	Model    string
+	Fallback GroundingChecker
+}
+
+// Check implements GroundingChecker.
+func (c *LLMGroundingChecker) Check(ctx context.Context, model, answer string, passages []contextPassage) (*groundingReport, error) {
+	claims := splitClaims(answer)
+	if len(claims) == 0 {
+		return newGroundingReport("llm", nil, nil), nil
+	}
+	if model == "" {
+		model = c.Model
+	}
+	supported, err := c.judge(ctx, model, claims, passages)
+	if err != nil {
+		if c.Fallback == nil {
+			return nil, err
+		}
+		return c.Fallback.Check(ctx, model, answer, passages)
+	}
+	return newGroundingReport("llm", claims, supported), nil
+}
+
+// groundingPrompt asks whether the numbered passages of context support each
+// claim.
+func groundingPrompt(context string, claims []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n\n%s\n", passagesLabel, context, claimsLabel)
+	for i, claim := range claims {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, claim)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, verdictsRequest, len(claims))
+	return b.String()
+}
+
+func (c *LLMGroundingChecker) judge(ctx context.Context, model string, claims []string, passages []contextPassage) ([]bool, error) {
+	texts := make([]string, len(passages))
+	for i, p := range passages {
+		texts[i] = p.Text
+	}
+	ctx = ai.WithInputs(ai.WithOperation(ctx, ai.OpVerify), ai.Inputs{Passages: texts, Claims: claims})
+	resp, err := c.AI.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Model: ModelOptions{Chat: model}.withDefaults().Chat,
+		Messages: []go_openai.ChatCompletionMessage{
+			{Role: "system", Content: "Check whether each claim is supported by the passages. A claim is supported only when the passages state it or directly imply it; citation markers such as [1] do not count as support."},
+			{Role: "user", Content: groundingPrompt(numberedContext(passages), claims)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no completion returned")
+	}
+	verdicts, err := utils.ParseNumbers(resp.Choices[0].Message.Content, len(claims))
+	if err != nil {
+		return nil, fmt.Errorf("invalid grounding reply: %w", err)
+	}
+	// Verdicts of at least 0.5 count as supported.
+	supported := make([]bool, len(verdicts))
+	for i, v := range verdicts {
+		supported[i] = v >= 0.5
+	}
+	return supported, nil
+}
+
+// checkGrounding runs the configured grounding check on an answer written by
+// model. A failing check leaves the answer unchecked rather than failing it.
+func (h *KBHandler) checkGrounding(ctx context.Context, model, answer string, passages []contextPassage) *groundingReport {
+	if h.Grounding == nil {
+		return nil
+	}
+	report, err := h.Grounding.Check(withUsage(ctx, 0, opVerify), model, answer, passages)
+	if err != nil {
+		log.Printf("grounding check failed: %v", err)
+		return nil
+	}
+	return report
+}
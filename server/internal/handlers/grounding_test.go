@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func groundingPassages() []contextPassage {
+	return []contextPassage{
+		{KBID: 7, FileName: "a.md", Text: "Passwords are reset from the account settings page."},
+		{KBID: 7, FileName: "b.md", Text: "Invoices are emailed on the first day of each month."},
+	}
+}
+
+func TestSplitClaims(t *testing.T) {
+	claims := splitClaims("Yes. Passwords are reset from the settings page [1]! Invoices arrive monthly?\nSee above")
+	assert.Equal(t, []string{"Passwords are reset from the settings page [1]!", "Invoices arrive monthly?"}, claims)
+}
+
+func TestLexicalGroundingChecker(t *testing.T) {
+	report, err := LexicalGroundingChecker{}.Check(context.Background(), "",
+		"Passwords are reset from the account settings page [1]. Refunds take ten business days.", groundingPassages())
+	assert.NoError(t, err)
+	assert.Equal(t, "lexical", report.Method)
+	assert.Equal(t, 0.5, report.Score)
+	assert.Equal(t, []string{"Refunds take ten business days."}, report.Unsupported)
+
+	report, _ = LexicalGroundingChecker{}.Check(context.Background(), "", "Yes.", groundingPassages())
+	assert.Equal(t, 1.0, report.Score, "an answer without claims is trivially grounded")
+	assert.Empty(t, report.Unsupported)
+}
+
+func TestLLMGroundingChecker(t *testing.T) {
+	answer := "Passwords are reset from the account settings page [1]. Invoices are emailed every week [2]."
+	ai := &chatStubAI{reply: "Verdicts: [1, 0]"}
+	checker, err := NewGroundingChecker("llm", ai, "m")
+	assert.NoError(t, err)
+
+	report, err := checker.Check(context.Background(), "", answer, groundingPassages())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ai.calls)
+	assert.Equal(t, []string{"m"}, ai.models)
+	assert.Equal(t, "llm", report.Method)
+	assert.Equal(t, 0.5, report.Score)
+	assert.Equal(t, []string{"Invoices are emailed every week [2]."}, report.Unsupported)
+
+	// The model that wrote the answer is used when given.
+	_, err = checker.Check(context.Background(), "kb-model", answer, groundingPassages())
+	assert.NoError(t, err)
+	assert.Equal(t, "kb-model", ai.models[1])
+
+	// A failing model call falls back to term overlap.
+	ai.err = errors.New("down")
+	report, err = checker.Check(context.Background(), "", answer, groundingPassages())
+	assert.NoError(t, err)
+	assert.Equal(t, "lexical", report.Method)
+
+	// So does a reply with the wrong number of verdicts.
+	ai.err = nil
+	ai.reply = "[1]"
+	report, _ = checker.Check(context.Background(), "", answer, groundingPassages())
+	assert.Equal(t, "lexical", report.Method)
+}
+
+func TestNewGroundingChecker(t *testing.T) {
+	checker, err := NewGroundingChecker("none", nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, checker)
+	_, err = NewGroundingChecker("bogus", nil, "")
+	assert.Error(t, err)
+}
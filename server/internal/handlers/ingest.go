@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const defaultChunkSize = 1000
+
+// ChunkingOptions controls how uploaded text is split into chunks of
+// ChunkSize characters. With a positive SectionSize files are first cut into
+// parent sections of that size, and each section into child chunks. Only the
+// children are embedded; the parent section is what the model sees when a
+// child is retrieved. A zero ChunkSize falls back to the default.
+type ChunkingOptions struct {
+	ChunkSize   int
+	SectionSize int
+}
+
+func (o ChunkingOptions) withDefaults() ChunkingOptions {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = defaultChunkSize
+	}
+	return o
+}
+
+// indexFile splits the text of an uploaded file into sections and chunks,
+// embeds the chunks and stores them. It returns the number of chunks created.
+func (h *KBHandler) indexFile(ctx context.Context, kb kbSettings, fileName, lookup, text string) (int, error) {
+	ctx = withUsage(ctx, kb.ID, opIndex)
+	opts := h.Chunking.withDefaults()
+	if opts.SectionSize <= 0 {
+		return h.indexChunks(ctx, kb, fileName, lookup, text, sql.NullInt64{}, 0, opts.ChunkSize)
+	}
+	var total int
+	for sectionIdx, section := range utils.ChunkText(text, opts.SectionSize) {
+		var sectionID int64
+		err := h.DB.QueryRowContext(ctx,
+			`INSERT INTO sections(kb_id, file_name, lookup_name, section_index, content) VALUES($1,$2,$3,$4,$5) RETURNING id`,
+			kb.ID, fileName, lookup, sectionIdx, section,
+		).Scan(&sectionID)
+		if err != nil {
+			return total, err
+		}
+		n, err := h.indexChunks(ctx, kb, fileName, lookup, section, sql.NullInt64{Int64: sectionID, Valid: true}, total, opts.ChunkSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// indexChunks embeds and stores the chunks of text, numbering them from
+// firstIndex so chunk_index stays sequential across a file's sections. Every
+// embedding must have the KB's dimensions.
+func (h *KBHandler) indexChunks(ctx context.Context, kb kbSettings, fileName, lookup, text string, sectionID sql.NullInt64, firstIndex, chunkSize int) (int, error) {
+	chunks := utils.ChunkText(text, chunkSize)
+	for i, chunk := range chunks {
+		vec, err := h.embedText(ctx, kb.EmbeddingModel, chunk)
+		if err != nil {
+			return i, &embeddingError{err}
+		}
+		if len(vec) != kb.EmbeddingDimensions {
+			return i, &embeddingError{fmt.Errorf("got %d dimensions, knowledge base expects %d", len(vec), kb.EmbeddingDimensions)}
+		}
+		_, err = h.DB.ExecContext(ctx,
+			`INSERT INTO chunks(kb_id, file_name, lookup_name, chunk_index, content, embedding, section_id) VALUES($1,$2,$3,$4,$5,$6::vector,$7)`,
+			kb.ID, fileName, lookup, firstIndex+i, chunk, vectorLiteral(vec), sectionID,
+		)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(chunks), nil
+}
+
+// embeddingError marks a failure of the embedding model, as opposed to a
+// database error, so the handler can report it accordingly.
+type embeddingError struct{ err error }
+
+func (e *embeddingError) Error() string { return "embedding failed: " + e.err.Error() }
+func (e *embeddingError) Unwrap() error { return e.err }
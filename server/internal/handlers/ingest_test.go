@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexFileCreatesSectionsAndChunks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// Two sections of two chunks each; chunk_index runs across sections.
+	text := "aaaa bbbb cccc dddd"
+	mock.ExpectQuery("INSERT INTO sections").
+		WithArgs(int64(1), "f.txt", "f-txt", 0, "aaaa bbbb").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	mock.ExpectExec("INSERT INTO chunks").
+		WithArgs(int64(1), "f.txt", "f-txt", 0, "aaaa", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO chunks").
+		WithArgs(int64(1), "f.txt", "f-txt", 1, "bbbb", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("INSERT INTO sections").
+		WithArgs(int64(1), "f.txt", "f-txt", 1, "cccc dddd").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+	mock.ExpectExec("INSERT INTO chunks").
+		WithArgs(int64(1), "f.txt", "f-txt", 2, "cccc", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO chunks").
+		WithArgs(int64(1), "f.txt", "f-txt", 3, "dddd", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	h := NewKBHandler(db, &recordingAI{emb: []float32{1, 0, 0}})
+	h.Chunking = ChunkingOptions{ChunkSize: 5, SectionSize: 10}
+	kb := kbSettings{ID: 1, EmbeddingModel: "test-embedding", EmbeddingDimensions: 3}
+	n, err := h.indexFile(context.Background(), kb, "f.txt", "f-txt", text)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIndexFileWithoutSections(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// Sections are opt-in: by default the chunks are stored without one.
+	mock.ExpectExec("INSERT INTO chunks").
+		WithArgs(int64(1), "f.txt", "f-txt", 0, "aaaa bbbb", sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	h := NewKBHandler(db, &recordingAI{emb: []float32{1, 0, 0}})
+	kb := kbSettings{ID: 1, EmbeddingModel: "test-embedding", EmbeddingDimensions: 3}
+	n, err := h.indexFile(context.Background(), kb, "f.txt", "f-txt", "aaaa bbbb")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPackPassages(t *testing.T) {
+	section := contextPassage{
+		Text:      strings.Repeat("word ", 50),
+		Hits:      []questionChunk{{Content: "word"}},
+		sectionID: 1,
+	}
+	plain := contextPassage{Text: "short passage", Hits: []questionChunk{{Content: "short passage"}}}
+	big := contextPassage{Text: strings.Repeat("other ", 50)}
+
+	// Each passage costs its text plus passageOverheadTokens for its label.
+	packed := packPassages([]contextPassage{plain, section, big}, 16)
+	if assert.Len(t, packed, 2) {
+		assert.Equal(t, "short passage", packed[0].Text)
+		assert.Equal(t, "word", packed[1].Text, "oversized section falls back to its hits")
+	}
+	assert.Len(t, packPassages([]contextPassage{plain, section, big}, 0), 3)
+}
+
+func TestSummarizeFile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO file_summaries").
+		WithArgs(int64(1), "f-txt", "f.txt", "answer", "[1.000000,0.000000,0.000000]").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	ai := &recordingAI{emb: []float32{1, 0, 0}}
+	h := NewKBHandler(db, ai)
+	assert.NoError(t, h.summarizeFile(context.Background(), kbSettings{ID: 1, EmbeddingModel: "test-embedding", EmbeddingDimensions: 3}, "f.txt", "f-txt", "the document text"))
+	assert.Contains(t, ai.lastPrompt, "the document text")
+	assert.Equal(t, "answer", ai.lastEmbInput)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
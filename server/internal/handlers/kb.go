@@ -4,8 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime"
 	"net/http"
 	"path/filepath"
@@ -19,22 +21,36 @@ import (
 	"bytes"
 
 	pdf "github.com/ledongthuc/pdf"
+	"github.com/zkiss/kb-codex/internal/ai"
 	"github.com/zkiss/kb-codex/internal/utils"
 )
 
 // KBHandler provides endpoints for managing knowledge bases and file uploads.
-// AIClient defines the subset of the OpenAI client used by the handler. It
-// allows injecting a fake implementation in tests so no real network calls are
-// made.
-type AIClient interface {
-	CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error)
-	CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error)
-}
+// AIClient is the AI provider used by the handler; see ai.Client.
+type AIClient = ai.Client
 
 // KBHandler provides endpoints for managing knowledge bases and file uploads.
 type KBHandler struct {
-	DB     *sql.DB
-	OpenAI AIClient
+	DB       *sql.DB
+	OpenAI   AIClient
+	Reranker Reranker
+	// Grounding checks answers against their context when set.
+	Grounding GroundingChecker
+	Retrieval RetrievalOptions
+	Chunking  ChunkingOptions
+	Prompt    PromptOptions
+	Models    ModelOptions
+	// SummarizeFiles generates and embeds a summary of every uploaded file
+	// for two-stage retrieval.
+	SummarizeFiles bool
+	// Quota holds the default monthly limits of every user.
+	Quota Quota
+	// AnswerCacheTTL is how long answers are reused for the same question;
+	// zero disables the answer cache.
+	AnswerCacheTTL time.Duration
+	// AnswerWithoutContext still asks the chat model when no chunk is
+	// relevant to a question, instead of answering noContextAnswer.
+	AnswerWithoutContext bool
 }
 
 // NewKBHandler constructs a KBHandler instance.
@@ -57,14 +73,92 @@ func (h *KBHandler) checkKBOwnership(kbID int64, userID int64) error {
 
 // createKBRequest represents the JSON payload for creating a knowledge base.
 type createKBRequest struct {
-	Name string `json:"name"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	DistanceMetric string `json:"distance_metric"`
+	SystemPrompt   string `json:"system_prompt"`
+	PromptTemplate string `json:"prompt_template"`
+	ChatModel      string `json:"chat_model"`
+	// EmbeddingModel is fixed for the lifetime of the KB.
+	EmbeddingModel string `json:"embedding_model"`
+}
+
+// updateKBRequest represents the JSON payload for changing knowledge base
+// settings. Omitted fields are left unchanged.
+type updateKBRequest struct {
+	Name           *string `json:"name"`
+	Description    *string `json:"description"`
+	DistanceMetric *string `json:"distance_metric"`
+	SystemPrompt   *string `json:"system_prompt"`
+	PromptTemplate *string `json:"prompt_template"`
+	ChatModel      *string `json:"chat_model"`
 }
 
 // KB represents a knowledge base.
 type KB struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int64          `json:"id"`
+	Name           string         `json:"name"`
+	Description    string         `json:"description"`
+	DistanceMetric DistanceMetric `json:"distance_metric"`
+	// SystemPrompt and PromptTemplate customise how answers are phrased;
+	// empty values use the defaults.
+	SystemPrompt   string `json:"system_prompt"`
+	PromptTemplate string `json:"prompt_template"`
+	// ChatModel overrides the default chat model when set.
+	ChatModel           string    `json:"chat_model"`
+	EmbeddingModel      string    `json:"embedding_model"`
+	EmbeddingDimensions int       `json:"embedding_dimensions"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// kbSettings holds the per-knowledge-base options that influence retrieval
+// and answering.
+type kbSettings struct {
+	ID             int64
+	Name           string
+	Description    string
+	DistanceMetric DistanceMetric
+	SystemPrompt   string
+	PromptTemplate string
+	// ChatModel is empty when the KB uses the default chat model.
+	ChatModel           string
+	EmbeddingModel      string
+	EmbeddingDimensions int
+	// ContentVersion changes whenever the KB's files do.
+	ContentVersion int64
+}
+
+// kbSettingsColumns are the columns scanned by scanKBSettings.
+const kbSettingsColumns = `id, name, description, distance_metric, system_prompt, prompt_template,
+	chat_model, embedding_model, embedding_dimensions, content_version`
+
+// scanKBSettings scans the kbSettingsColumns of a row, followed by extra.
+func scanKBSettings(row interface{ Scan(...any) error }, s *kbSettings, extra ...any) error {
+	return row.Scan(append([]any{&s.ID, &s.Name, &s.Description, &s.DistanceMetric, &s.SystemPrompt, &s.PromptTemplate,
+		&s.ChatModel, &s.EmbeddingModel, &s.EmbeddingDimensions, &s.ContentVersion}, extra...)...)
+}
+
+// loadKBSettings reads the settings of a knowledge base. Ownership must be
+// checked by the caller.
+func (h *KBHandler) loadKBSettings(ctx context.Context, kbID int64) (kbSettings, error) {
+	var s kbSettings
+	err := scanKBSettings(h.DB.QueryRowContext(ctx, `SELECT `+kbSettingsColumns+` FROM knowledge_bases WHERE id = $1`, kbID), &s)
+	return s, err
+}
+
+// descriptionEmbedding embeds a KB description with the KB's embedding model
+// for question routing. An empty description has no embedding and is stored as
+// NULL.
+func (h *KBHandler) descriptionEmbedding(ctx context.Context, model, description string) (any, error) {
+	if strings.TrimSpace(description) == "" {
+		return nil, nil
+	}
+	ctx = withUsage(ctx, 0, opDescribe)
+	vec, err := h.embedText(ctx, model, description)
+	if err != nil {
+		return nil, err
+	}
+	return vectorLiteral(vec), nil
 }
 
 // CreateKB handles POST /api/kbs
@@ -80,18 +174,198 @@ func (h *KBHandler) CreateKB(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request payload", http.StatusBadRequest)
 		return
 	}
+	metric, err := ParseDistanceMetric(req.DistanceMetric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePrompt(req.SystemPrompt, req.PromptTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.Models.validateChatModel(req.ChatModel); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	embeddingModel := req.EmbeddingModel
+	if embeddingModel == "" {
+		embeddingModel = h.Models.withDefaults().Embedding
+	}
+	dimensions, err := h.embeddingDimensions(r.Context(), embeddingModel)
+	if err != nil {
+		http.Error(w, "embedding model unavailable: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkIndexable(embeddingModel, dimensions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	descEmbedding, err := h.descriptionEmbedding(r.Context(), embeddingModel, req.Description)
+	if err != nil {
+		http.Error(w, "embedding failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The KB is only kept together with its vector index.
+	tx, err := h.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 	var id int64
 	var createdAt time.Time
-	err = h.DB.QueryRow(
-		`INSERT INTO knowledge_bases(name, user_id) VALUES ($1, $2) RETURNING id, created_at`,
-		req.Name, userID,
+	err = tx.QueryRowContext(r.Context(),
+		`INSERT INTO knowledge_bases(name, user_id, distance_metric, description, description_embedding, system_prompt, prompt_template, chat_model, embedding_model, embedding_dimensions)
+		VALUES ($1, $2, $3, $4, $5::vector, $6, $7, $8, $9, $10) RETURNING id, created_at`,
+		req.Name, userID, metric, req.Description, descEmbedding, req.SystemPrompt, req.PromptTemplate, req.ChatModel, embeddingModel, dimensions,
 	).Scan(&id, &createdAt)
 	if err != nil {
 		http.Error(w, "could not create knowledge base: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := ensureVectorIndex(r.Context(), tx, id, metric, dimensions); err != nil {
+		http.Error(w, "could not create vector index: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "could not create knowledge base: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(KB{
+		ID:                  id,
+		Name:                req.Name,
+		Description:         req.Description,
+		DistanceMetric:      metric,
+		SystemPrompt:        req.SystemPrompt,
+		PromptTemplate:      req.PromptTemplate,
+		ChatModel:           req.ChatModel,
+		EmbeddingModel:      embeddingModel,
+		EmbeddingDimensions: dimensions,
+		CreatedAt:           createdAt,
+	})
+}
+
+// UpdateKB handles PATCH /api/kbs/{kbID}
+func (h *KBHandler) UpdateKB(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req updateKBRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Name != nil && *req.Name == "") {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	current, err := h.loadKBSettings(ctx, kbID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	name := current.Name
+	if req.Name != nil {
+		name = *req.Name
+	}
+	metric := current.DistanceMetric
+	if req.DistanceMetric != nil {
+		metric, err = ParseDistanceMetric(*req.DistanceMetric)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	systemPrompt := current.SystemPrompt
+	if req.SystemPrompt != nil {
+		systemPrompt = *req.SystemPrompt
+	}
+	promptTemplate := current.PromptTemplate
+	if req.PromptTemplate != nil {
+		promptTemplate = *req.PromptTemplate
+	}
+	if err := validatePrompt(systemPrompt, promptTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chatModel := current.ChatModel
+	if req.ChatModel != nil {
+		chatModel = *req.ChatModel
+		if err := h.Models.validateChatModel(chatModel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var descEmbedding any
+	if req.Description != nil && *req.Description != current.Description {
+		descEmbedding, err = h.descriptionEmbedding(withUsage(ctx, kbID, ""), current.EmbeddingModel, *req.Description)
+		if err != nil {
+			http.Error(w, "embedding failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The metric is only changed together with the index built for it.
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if req.Description != nil && *req.Description != current.Description {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE knowledge_bases SET description = $1, description_embedding = $2::vector WHERE id = $3`,
+			*req.Description, descEmbedding, kbID,
+		)
+		if err != nil {
+			http.Error(w, "could not update knowledge base: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var kb KB
+	err = tx.QueryRowContext(ctx,
+		`UPDATE knowledge_bases SET name = $1, distance_metric = $2, system_prompt = $3, prompt_template = $4, chat_model = $5 WHERE id = $6
+		RETURNING id, name, description, distance_metric, system_prompt, prompt_template, chat_model, embedding_model, embedding_dimensions, created_at`,
+		name, metric, systemPrompt, promptTemplate, chatModel, kbID,
+	).Scan(&kb.ID, &kb.Name, &kb.Description, &kb.DistanceMetric, &kb.SystemPrompt, &kb.PromptTemplate,
+		&kb.ChatModel, &kb.EmbeddingModel, &kb.EmbeddingDimensions, &kb.CreatedAt)
+	if err != nil {
+		http.Error(w, "could not update knowledge base: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if metric != current.DistanceMetric {
+		if err := ensureVectorIndex(ctx, tx, kbID, metric, current.EmbeddingDimensions); err != nil {
+			http.Error(w, "could not rebuild vector index: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Another metric retrieves other chunks.
+		if err := contentChanged(ctx, tx, kbID); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "could not update knowledge base: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(KB{ID: id, Name: req.Name, CreatedAt: createdAt})
+	json.NewEncoder(w).Encode(kb)
 }
 
 // ListKB handles GET /api/kbs
@@ -102,7 +376,8 @@ func (h *KBHandler) ListKB(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := h.DB.Query(`SELECT id, name, created_at FROM knowledge_bases WHERE user_id = $1 ORDER BY id`, userID)
+	rows, err := h.DB.Query(`SELECT id, name, description, distance_metric, system_prompt, prompt_template,
+		chat_model, embedding_model, embedding_dimensions, created_at FROM knowledge_bases WHERE user_id = $1 ORDER BY id`, userID)
 	if err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
@@ -112,7 +387,8 @@ func (h *KBHandler) ListKB(w http.ResponseWriter, r *http.Request) {
 	var list []KB
 	for rows.Next() {
 		var kb KB
-		if err := rows.Scan(&kb.ID, &kb.Name, &kb.CreatedAt); err != nil {
+		if err := rows.Scan(&kb.ID, &kb.Name, &kb.Description, &kb.DistanceMetric, &kb.SystemPrompt, &kb.PromptTemplate,
+			&kb.ChatModel, &kb.EmbeddingModel, &kb.EmbeddingDimensions, &kb.CreatedAt); err != nil {
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
 		}
@@ -255,6 +531,9 @@ func (h *KBHandler) UploadFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "could not read file", http.StatusInternalServerError)
 		return
 	}
+	if !h.checkQuota(w, r, userID, []int64{kbID}, Quota{UploadBytes: int64(len(contentBytes))}) {
+		return
+	}
 	var contentStr string
 	if ext == ".pdf" {
 		// Extract text from PDF
@@ -296,35 +575,36 @@ func (h *KBHandler) UploadFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "could not store file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	chunks := utils.ChunkText(contentStr, 1000)
-	ctx := r.Context()
-	for idx, chunk := range chunks {
-		embReq := go_openai.EmbeddingRequest{
-			Model: go_openai.AdaEmbeddingV2,
-			Input: []string{chunk},
-		}
-		embResp, err := h.OpenAI.CreateEmbeddings(ctx, embReq)
-		if err != nil {
-			http.Error(w, "embedding failed: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		vec := embResp.Data[0].Embedding
-		parts := make([]string, len(vec))
-		for i, v := range vec {
-			parts[i] = fmt.Sprintf("%f", v)
-		}
-		arrLit := "[" + strings.Join(parts, ",") + "]"
-		_, err = h.DB.Exec(
-			`INSERT INTO chunks(kb_id, file_name, chunk_index, content, embedding) VALUES($1,$2,$3,$4,$5::vector)`,
-			kbID, header.Filename, idx, chunk, arrLit,
-		)
-		if err != nil {
+	if err := h.recordUpload(r.Context(), userID, kbID, header.Filename, len(contentBytes)); err != nil {
+		log.Printf("could not record upload of %s to kb %d: %v", header.Filename, kbID, err)
+	}
+	kb, err := h.loadKBSettings(r.Context(), kbID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	n, err := h.indexFile(r.Context(), kb, header.Filename, lookup, contentStr)
+	if err != nil {
+		var embErr *embeddingError
+		if errors.As(err, &embErr) {
+			http.Error(w, embErr.Error(), http.StatusInternalServerError)
+		} else {
 			http.Error(w, "could not save chunk: "+err.Error(), http.StatusInternalServerError)
-			return
+		}
+		return
+	}
+	if h.SummarizeFiles {
+		// The chunks are stored already; a missing summary only excludes the
+		// file from two-stage retrieval, so it does not fail the upload.
+		if err := h.summarizeFile(r.Context(), kb, header.Filename, lookup, contentStr); err != nil {
+			log.Printf("could not summarise %s in kb %d: %v", header.Filename, kbID, err)
 		}
 	}
+	if err := contentChanged(r.Context(), h.DB, kbID); err != nil {
+		log.Printf("could not invalidate cached answers of kb %d: %v", kbID, err)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{"chunks": len(chunks)})
+	json.NewEncoder(w).Encode(map[string]int{"chunks": n})
 }
 
 // questionRequest represents a question about a knowledge base.
@@ -336,21 +616,68 @@ type chatMessage struct {
 type questionRequest struct {
 	Question string        `json:"question"`
 	History  []chatMessage `json:"history"`
+	// MMRLambda overrides the configured relevance/diversity trade-off.
+	MMRLambda *float64 `json:"mmr_lambda"`
+	// Neighbours overrides how many adjacent chunks widen each hit.
+	Neighbours *int `json:"neighbours"`
+	// RetrievalMode overrides the configured retrieval mode ("chunks" or
+	// "two_stage").
+	RetrievalMode string `json:"retrieval_mode"`
+	// ConversationID continues a stored conversation: its messages replace
+	// History and the new exchange is appended to it.
+	ConversationID int64 `json:"conversation_id"`
+	// Model, Temperature and MaxTokens tune the answering chat request. The
+	// model must be allowed by the configuration and MaxTokens may not exceed
+	// the tokens reserved for the answer.
+	Model       string   `json:"model"`
+	Temperature *float32 `json:"temperature"`
+	MaxTokens   *int     `json:"max_tokens"`
+	// NoCache answers afresh instead of reusing a cached answer.
+	NoCache bool `json:"no_cache"`
+	// MinSimilarity overrides the configured similarity below which chunks
+	// are not relevant context.
+	MinSimilarity *float64 `json:"min_similarity"`
 }
 
 // questionResponse represents the answer returned to the client.
 type questionChunk struct {
-	FileName string `json:"file_name"`
-	Index    int    `json:"index"`
-	Content  string `json:"content"`
+	ID         int64   `json:"id"`
+	KBID       int64   `json:"kb_id"`
+	KBName     string  `json:"kb_name"`
+	FileName   string  `json:"file_name"`
+	FileSlug   string  `json:"file_slug"`
+	Index      int     `json:"index"`
+	Content    string  `json:"content"`
+	Distance   float64 `json:"distance"`
+	Similarity float64 `json:"similarity"`
+	Relevance  float64 `json:"relevance,omitempty"`
+
+	embedding []float32
+	sectionID int64
 }
 
 type questionResponse struct {
 	Answer string          `json:"answer"`
 	Chunks []questionChunk `json:"chunks"`
+	// Citations resolve the [n] markers in Answer to their passages.
+	Citations []citation `json:"citations"`
+	// Routing explains which KBs were consulted when none were named.
+	Routing        []kbRoute `json:"routing,omitempty"`
+	ConversationID int64     `json:"conversation_id,omitempty"`
+	// Cached is set when the answer was reused from the answer cache.
+	Cached bool `json:"cached,omitempty"`
+	// NoRelevantContext is set when no chunk was close enough to the
+	// question to be used as context.
+	NoRelevantContext bool `json:"no_relevant_context,omitempty"`
+	// Grounding reports how well the answer is supported by its context
+	// when the grounding check is enabled.
+	Grounding *groundingReport `json:"grounding,omitempty"`
+	// AnswerID identifies the recorded answer for feedback.
+	AnswerID int64 `json:"answer_id,omitempty"`
 }
 
-func rewriteQuestion(ctx context.Context, ai AIClient, history []chatMessage, q string) (string, error) {
+func rewriteQuestion(ctx context.Context, ai AIClient, model string, history []chatMessage, q string) (string, error) {
+	ctx = withUsage(ctx, 0, opRewrite)
 	messages := []go_openai.ChatCompletionMessage{
 		{Role: "system", Content: "Rewrite the user's question to be a standalone question using the conversation history."},
 	}
@@ -359,7 +686,7 @@ func rewriteQuestion(ctx context.Context, ai AIClient, history []chatMessage, q
 	}
 	messages = append(messages, go_openai.ChatCompletionMessage{Role: "user", Content: q})
 	resp, err := ai.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
-		Model:    go_openai.GPT3Dot5Turbo,
+		Model:    model,
 		Messages: messages,
 	})
 	if err != nil {
@@ -393,73 +720,66 @@ func (h *KBHandler) AskQuestion(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request payload", http.StatusBadRequest)
 		return
 	}
-
-	ctx := r.Context()
-	q := req.Question
-	if len(req.History) > 0 {
-		q, err = rewriteQuestion(ctx, h.OpenAI, req.History, req.Question)
+	if msg := h.validateQuestionRequest(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if req.ConversationID != 0 {
+		if len(req.History) > 0 {
+			http.Error(w, "history cannot be combined with conversation_id", http.StatusBadRequest)
+			return
+		}
+		req.History, err = h.conversationHistory(r.Context(), kbID, req.ConversationID)
+		if errors.Is(err, errConversationNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, "question rewrite failed: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "server error", http.StatusInternalServerError)
 			return
 		}
 	}
-	embReq := go_openai.EmbeddingRequest{
-		Model: go_openai.AdaEmbeddingV2,
-		Input: []string{q},
+
+	if !h.checkQuota(w, r, userID, []int64{kbID}, Quota{Questions: 1}) {
+		return
 	}
-	embResp, err := h.OpenAI.CreateEmbeddings(ctx, embReq)
+
+	kb, err := h.loadKBSettings(r.Context(), kbID)
 	if err != nil {
-		http.Error(w, "embedding failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
-	vec := embResp.Data[0].Embedding
+	h.answer(w, r, userID, []kbSettings{kb}, false, req)
+}
+
+// vectorLiteral formats an embedding as a pgvector text literal.
+func vectorLiteral(vec []float32) string {
 	parts := make([]string, len(vec))
 	for i, v := range vec {
 		parts[i] = fmt.Sprintf("%f", v)
 	}
-	arrLit := "[" + strings.Join(parts, ",") + "]"
+	return "[" + strings.Join(parts, ",") + "]"
+}
 
-	rows, err := h.DB.QueryContext(ctx,
-		`SELECT file_name, chunk_index, content FROM chunks WHERE kb_id=$1 ORDER BY embedding <-> $2::vector LIMIT 5`,
-		kbID, arrLit,
-	)
-	if err != nil {
-		http.Error(w, "search failed: "+err.Error(), http.StatusInternalServerError)
-		return
+// parseVectorLiteral parses the pgvector text representation of a vector.
+func parseVectorLiteral(s string) ([]float32, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return nil, fmt.Errorf("invalid vector literal")
 	}
-	defer rows.Close()
-
-	var contextParts []string
-	var chunks []questionChunk
-	for rows.Next() {
-		var c questionChunk
-		if err := rows.Scan(&c.FileName, &c.Index, &c.Content); err != nil {
-			http.Error(w, "search failed: "+err.Error(), http.StatusInternalServerError)
-			return
+	fields := strings.Split(s[1:len(s)-1], ",")
+	vec := make([]float32, 0, len(fields))
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
 		}
-		contextParts = append(contextParts, c.Content)
-		chunks = append(chunks, c)
-	}
-
-	prompt := fmt.Sprintf("Answer the question based on the following context:\n\n%s\n\nQuestion: %s",
-		strings.Join(contextParts, "\n---\n"), req.Question)
-
-	chatReq := go_openai.ChatCompletionRequest{
-		Model: go_openai.GPT3Dot5Turbo,
-		Messages: []go_openai.ChatCompletionMessage{
-			{Role: "system", Content: "You are a helpful assistant."},
-			{Role: "user", Content: prompt},
-		},
-	}
-	chatResp, err := h.OpenAI.CreateChatCompletion(ctx, chatReq)
-	if err != nil {
-		http.Error(w, "openai failed: "+err.Error(), http.StatusInternalServerError)
-		return
+		v, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector literal: %w", err)
+		}
+		vec = append(vec, float32(v))
 	}
-	answer := chatResp.Choices[0].Message.Content
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(questionResponse{Answer: answer, Chunks: chunks})
+	return vec, nil
 }
 
 // extractTextFromPDF extracts text from a PDF file given as []byte.
@@ -23,6 +23,54 @@ import (
 )
 
 // helper to start a postgres container with a simplified schema
+func TestSearchChunksOfFarFilesComponent(t *testing.T) {
+	pg, db := setupVectorDB(t, 3)
+	defer pg.Terminate(context.Background())
+	defer db.Close()
+	// Keep every query on the one session whose planner must use the index.
+	db.SetMaxOpenConns(1)
+
+	var userID, kbID int64
+	if err := db.QueryRow(`INSERT INTO users(email, password_hash, created_at, updated_at) VALUES('far@example.com', 'hash', NOW(), NOW()) RETURNING id`).Scan(&userID); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	if err := db.QueryRow(`INSERT INTO knowledge_bases(name, user_id) VALUES('kb1', $1) RETURNING id`, userID).Scan(&kbID); err != nil {
+		t.Fatalf("insert kb: %v", err)
+	}
+	// Far more chunks of near.txt than ef_search lie closer to the question
+	// than any chunk of far.txt.
+	for i := range 200 {
+		_, err := db.Exec(`INSERT INTO chunks(kb_id,file_name,lookup_name,chunk_index,content,embedding) VALUES($1,'near.txt','near-txt',$2,'near',$3::vector)`,
+			kbID, i, toArrayLit([]float32{1, float32(i) / 1000, 0}))
+		if err != nil {
+			t.Fatalf("insert chunk: %v", err)
+		}
+	}
+	for i := range 3 {
+		_, err := db.Exec(`INSERT INTO chunks(kb_id,file_name,lookup_name,chunk_index,content,embedding) VALUES($1,'far.txt','far-txt',$2,'far',$3::vector)`,
+			kbID, i, toArrayLit([]float32{0, 1, float32(i) / 10}))
+		if err != nil {
+			t.Fatalf("insert chunk: %v", err)
+		}
+	}
+	kb := kbSettings{ID: kbID, DistanceMetric: DistanceCosine, EmbeddingDimensions: 3}
+	if err := ensureVectorIndex(context.Background(), db, kbID, kb.DistanceMetric, kb.EmbeddingDimensions); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	if _, err := db.Exec(`SET enable_seqscan = off`); err != nil {
+		t.Fatalf("disable seqscan: %v", err)
+	}
+
+	h := NewKBHandler(db, nil)
+	out, err := h.searchChunks(context.Background(), kb, []float32{1, 0, 0}, searchOptions{Limit: 3, Files: []string{"far-txt"}})
+	assert.NoError(t, err)
+	if assert.Len(t, out, 3) {
+		for _, c := range out {
+			assert.Equal(t, "far-txt", c.FileSlug)
+		}
+	}
+}
+
 func setupVectorDB(t *testing.T, dim int) (*postgres.PostgresContainer, *sql.DB) {
 	t.Helper()
 	testutil.RequireDocker(t)
@@ -52,8 +100,13 @@ func setupVectorDB(t *testing.T, dim int) (*postgres.PostgresContainer, *sql.DB)
 		t.Fatalf("enable pgvector: %v", err)
 	}
 	schema := fmt.Sprintf(`CREATE TABLE users(id SERIAL PRIMARY KEY, email TEXT UNIQUE, password_hash TEXT, created_at TIMESTAMPTZ, updated_at TIMESTAMPTZ);
-CREATE TABLE knowledge_bases(id SERIAL PRIMARY KEY, name TEXT, user_id INTEGER REFERENCES users(id));
-CREATE TABLE chunks(id SERIAL PRIMARY KEY, kb_id INTEGER, file_name TEXT, chunk_index INTEGER, content TEXT, embedding VECTOR(%d));`, dim)
+CREATE TABLE knowledge_bases(id SERIAL PRIMARY KEY, name TEXT, user_id INTEGER REFERENCES users(id), distance_metric TEXT NOT NULL DEFAULT 'cosine', description TEXT NOT NULL DEFAULT '', description_embedding VECTOR(%[1]d), system_prompt TEXT NOT NULL DEFAULT '', prompt_template TEXT NOT NULL DEFAULT '', chat_model TEXT NOT NULL DEFAULT '', embedding_model TEXT NOT NULL DEFAULT 'test-embedding', embedding_dimensions INTEGER NOT NULL DEFAULT %[1]d, content_version INTEGER NOT NULL DEFAULT 0);
+CREATE TABLE sections(id SERIAL PRIMARY KEY, kb_id INTEGER, file_name TEXT, lookup_name TEXT, section_index INTEGER, content TEXT);
+CREATE TABLE chunks(id SERIAL PRIMARY KEY, kb_id INTEGER, file_name TEXT, lookup_name TEXT NOT NULL DEFAULT '', chunk_index INTEGER, content TEXT, embedding VECTOR(%[1]d), section_id INTEGER REFERENCES sections(id));
+CREATE TABLE user_limits(user_id INTEGER PRIMARY KEY, tokens BIGINT, upload_bytes BIGINT, questions BIGINT);
+CREATE TABLE kb_limits(kb_id INTEGER PRIMARY KEY, tokens BIGINT, upload_bytes BIGINT, questions BIGINT);
+CREATE TABLE answer_cache(key TEXT PRIMARY KEY, kb_ids INTEGER[] NOT NULL, response JSONB NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), expires_at TIMESTAMPTZ NOT NULL);
+CREATE TABLE answers(id BIGSERIAL PRIMARY KEY, user_id INTEGER, kb_ids INTEGER[] NOT NULL, question TEXT NOT NULL, answer TEXT NOT NULL, chunk_ids INTEGER[] NOT NULL DEFAULT '{}', citations JSONB NOT NULL DEFAULT '[]', created_at TIMESTAMPTZ NOT NULL DEFAULT now());`, dim)
 	if _, err := db.Exec(schema); err != nil {
 		pg.Terminate(ctx)
 		t.Fatalf("create tables: %v", err)
@@ -85,6 +138,11 @@ func (r *recordingAI) CreateChatCompletion(ctx context.Context, req go_openai.Ch
 	return go_openai.ChatCompletionResponse{Choices: []go_openai.ChatCompletionChoice{{Message: go_openai.ChatCompletionMessage{Content: "answer"}}}}, nil
 }
 
+func (r *recordingAI) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ChatStream, error) {
+	r.lastPrompt = req.Messages[len(req.Messages)-1].Content
+	return &staticStream{deltas: []string{"ans", "wer"}}, nil
+}
+
 func toArrayLit(vec []float32) string {
 	parts := make([]string, len(vec))
 	for i, v := range vec {
@@ -93,8 +151,23 @@ func toArrayLit(vec []float32) string {
 	return "[" + strings.Join(parts, ",") + "]"
 }
 
+// promptRecorder remembers the last chat prompt sent to the client it wraps.
+type promptRecorder struct {
+	AIClient
+	lastPrompt string
+}
+
+func (p *promptRecorder) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	p.lastPrompt = req.Messages[len(req.Messages)-1].Content
+	return p.AIClient.CreateChatCompletion(ctx, req)
+}
+
 func TestAskQuestionComponent(t *testing.T) {
-	pg, db := setupVectorDB(t, 3)
+	// The golden files hold OpenAI's embeddings of the chunks and the question
+	// and its answer to the prompt built from them.
+	const goldens = "testdata/ai/ask_question"
+	testutil.RequireAIRecording(t, goldens)
+	pg, db := setupVectorDB(t, 1536)
 	defer pg.Terminate(context.Background())
 	defer db.Close()
 
@@ -106,24 +179,30 @@ func TestAskQuestionComponent(t *testing.T) {
 	}
 
 	var kbID int64
-	err = db.QueryRow(`INSERT INTO knowledge_bases(name, user_id) VALUES('kb1', $1) RETURNING id`, userID).Scan(&kbID)
+	err = db.QueryRow(`INSERT INTO knowledge_bases(name, user_id, chat_model, embedding_model) VALUES('kb1', $1, 'gpt-4o-mini', 'text-embedding-3-small') RETURNING id`, userID).Scan(&kbID)
 	if err != nil {
 		t.Fatalf("insert kb: %v", err)
 	}
-	// insert chunks
-	_, err = db.Exec(`INSERT INTO chunks(kb_id,file_name,chunk_index,content,embedding) VALUES($1,'f.txt',0,'alpha',$2::vector)`, kbID, toArrayLit([]float32{1, 0, 0}))
-	if err != nil {
-		t.Fatalf("insert chunk: %v", err)
-	}
-	_, err = db.Exec(`INSERT INTO chunks(kb_id,file_name,chunk_index,content,embedding) VALUES($1,'f.txt',1,'bravo',$2::vector)`, kbID, toArrayLit([]float32{0, 1, 0}))
-	if err != nil {
-		t.Fatalf("insert chunk: %v", err)
+	recording := testutil.NewAIRecording(t, goldens)
+	ai := &promptRecorder{AIClient: recording}
+	// insert chunks, embedded by the KB's model
+	for i, content := range []string{"The alpha release ships on Monday.", "Bravo is the name of the office cat."} {
+		emb, err := recording.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{
+			Model: go_openai.SmallEmbedding3,
+			Input: []string{content},
+		})
+		if err != nil || len(emb.Data) == 0 {
+			t.Fatalf("embed chunk: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO chunks(kb_id,file_name,chunk_index,content,embedding) VALUES($1,'f.txt',$2,$3,$4::vector)`, kbID, i, content, toArrayLit(emb.Data[0].Embedding))
+		if err != nil {
+			t.Fatalf("insert chunk: %v", err)
+		}
 	}
 
-	ai := &recordingAI{emb: []float32{1, 0, 0}}
 	h := NewKBHandler(db, ai)
 
-	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/kbs/%d/ask", kbID), strings.NewReader(`{"question":"q"}`))
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/kbs/%d/ask", kbID), strings.NewReader(`{"question":"When does the alpha release ship?"}`))
 	rctx := chi.NewRouteContext()
 	rctx.URLParams.Add("kbID", fmt.Sprint(kbID))
 	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
@@ -134,9 +213,12 @@ func TestAskQuestionComponent(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Contains(t, ai.lastPrompt, "alpha")
-	var resp map[string]any
+	var resp questionResponse
 	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
-	assert.Equal(t, "answer", resp["answer"])
+	assert.Contains(t, resp.Answer, "Monday")
+	if assert.Len(t, resp.Chunks, 2) {
+		assert.Contains(t, resp.Chunks[0].Content, "alpha")
+	}
 }
 
 func TestAskQuestionFollowup(t *testing.T) {
@@ -179,6 +261,100 @@ func TestAskQuestionFollowup(t *testing.T) {
 	assert.Equal(t, "rewritten", ai.lastEmbInput)
 }
 
+func TestSearchComponent(t *testing.T) {
+	pg, db := setupVectorDB(t, 3)
+	defer pg.Terminate(context.Background())
+	defer db.Close()
+
+	var userID int64
+	err := db.QueryRow(`INSERT INTO users(email, password_hash, created_at, updated_at) VALUES('search@example.com', 'hash', NOW(), NOW()) RETURNING id`).Scan(&userID)
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	var kbID int64
+	err = db.QueryRow(`INSERT INTO knowledge_bases(name, user_id) VALUES('kb1', $1) RETURNING id`, userID).Scan(&kbID)
+	if err != nil {
+		t.Fatalf("insert kb: %v", err)
+	}
+	for i, emb := range [][]float32{{1, 0, 0}, {0.8, 0.6, 0}, {0, 0, 1}} {
+		_, err = db.Exec(`INSERT INTO chunks(kb_id,file_name,lookup_name,chunk_index,content,embedding) VALUES($1,'f.txt','f-txt',$2,$3,$4::vector)`,
+			kbID, i, fmt.Sprintf("chunk %d", i), toArrayLit(emb))
+		if err != nil {
+			t.Fatalf("insert chunk: %v", err)
+		}
+	}
+
+	ai := &recordingAI{emb: []float32{1, 0, 0}}
+	h := NewKBHandler(db, ai)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/kbs/%d/search?q=alpha&limit=1&offset=1&min_similarity=0.5", kbID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("kbID", fmt.Sprint(kbID))
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, utils.UserIDKey, userID)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	h.Search(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "alpha", ai.lastEmbInput)
+	var resp searchResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	if assert.Len(t, resp.Results, 1) {
+		assert.Equal(t, "f-txt", resp.Results[0].FileSlug)
+		assert.Equal(t, 1, resp.Results[0].ChunkIndex)
+		assert.InDelta(t, 0.8, resp.Results[0].Score, 1e-6)
+	}
+}
+
+func TestAskQuestionUsesParentSection(t *testing.T) {
+	pg, db := setupVectorDB(t, 3)
+	defer pg.Terminate(context.Background())
+	defer db.Close()
+
+	var userID int64
+	err := db.QueryRow(`INSERT INTO users(email, password_hash, created_at, updated_at) VALUES('sections@example.com', 'hash', NOW(), NOW()) RETURNING id`).Scan(&userID)
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	var kbID int64
+	err = db.QueryRow(`INSERT INTO knowledge_bases(name, user_id) VALUES('kb1', $1) RETURNING id`, userID).Scan(&kbID)
+	if err != nil {
+		t.Fatalf("insert kb: %v", err)
+	}
+	var sectionID int64
+	err = db.QueryRow(`INSERT INTO sections(kb_id,file_name,lookup_name,section_index,content) VALUES($1,'f.txt','f-txt',0,'alpha bravo charlie') RETURNING id`, kbID).Scan(&sectionID)
+	if err != nil {
+		t.Fatalf("insert section: %v", err)
+	}
+	for i, c := range []string{"alpha", "bravo"} {
+		_, err = db.Exec(`INSERT INTO chunks(kb_id,file_name,lookup_name,chunk_index,content,embedding,section_id) VALUES($1,'f.txt','f-txt',$2,$3,$4::vector,$5)`,
+			kbID, i, c, toArrayLit([]float32{1, float32(i), 0}), sectionID)
+		if err != nil {
+			t.Fatalf("insert chunk: %v", err)
+		}
+	}
+
+	ai := &recordingAI{emb: []float32{1, 0, 0}}
+	h := NewKBHandler(db, ai)
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/kbs/%d/ask", kbID), strings.NewReader(`{"question":"q"}`))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("kbID", fmt.Sprint(kbID))
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, utils.UserIDKey, userID)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	h.AskQuestion(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, ai.lastPrompt, "alpha bravo charlie")
+	assert.Equal(t, 1, strings.Count(ai.lastPrompt, "charlie"), "parent section should be included once")
+	var resp questionResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Len(t, resp.Chunks, 2)
+}
+
 func TestExtractTextFromPDF(t *testing.T) {
 	// Minimal PDF with the text 'Hello PDF'
 	pdfBytes, err := os.ReadFile("testdata/pdf_test.pdf")
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+
+	go_openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultChatModel      = go_openai.GPT4oMini
+	defaultEmbeddingModel = string(go_openai.SmallEmbedding3)
+
+	// maxTemperature is the highest sampling temperature the API accepts.
+	maxTemperature = 2
+)
+
+// knownEmbeddingDimensions lists the vector size of common embedding models
+// so that creating a KB does not need a probe request for them.
+var knownEmbeddingDimensions = map[string]int{
+	string(go_openai.AdaEmbeddingV2):  1536,
+	string(go_openai.SmallEmbedding3): 1536,
+	string(go_openai.LargeEmbedding3): 3072,
+}
+
+// ModelOptions selects the models used for chat and embeddings. Zero values
+// fall back to the defaults.
+type ModelOptions struct {
+	// Chat is the chat model used unless a KB or a request picks another.
+	Chat string
+	// AllowedChat lists the further chat models KBs and requests may pick.
+	AllowedChat []string
+	// Embedding is the embedding model of newly created KBs. A KB keeps the
+	// model it was created with, since its vectors are only comparable with
+	// vectors of the same model.
+	Embedding string
+}
+
+func (o ModelOptions) withDefaults() ModelOptions {
+	if o.Chat == "" {
+		o.Chat = defaultChatModel
+	}
+	if o.Embedding == "" {
+		o.Embedding = defaultEmbeddingModel
+	}
+	return o
+}
+
+// chatAllowed reports whether model may be chosen by a KB or a request.
+func (o ModelOptions) chatAllowed(model string) bool {
+	o = o.withDefaults()
+	return model == o.Chat || slices.Contains(o.AllowedChat, model)
+}
+
+// chatModel returns the model answering from kbs: the requested one, else the
+// model of a single KB, else the default.
+func (o ModelOptions) chatModel(kbs []kbSettings, requested string) string {
+	o = o.withDefaults()
+	if requested != "" {
+		return requested
+	}
+	if len(kbs) == 1 && kbs[0].ChatModel != "" {
+		return kbs[0].ChatModel
+	}
+	return o.Chat
+}
+
+// validateChatModel checks a chat model chosen by a KB or a request. The
+// empty string selects the default.
+func (o ModelOptions) validateChatModel(model string) error {
+	if model != "" && !o.chatAllowed(model) {
+		return fmt.Errorf("model %q is not allowed", model)
+	}
+	return nil
+}
+
+// apiTemperature converts a requested temperature for the chat request, whose
+// zero value is omitted and would select the API default instead of greedy
+// sampling.
+func apiTemperature(t float32) float32 {
+	if t == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return t
+}
+
+// embeddingDimensions returns the vector size produced by an embedding model,
+// probing the model when it is not a known one. The probe also checks that
+// the model is available.
+func (h *KBHandler) embeddingDimensions(ctx context.Context, model string) (int, error) {
+	if n, ok := knownEmbeddingDimensions[model]; ok {
+		return n, nil
+	}
+	vec, err := h.embedText(withUsage(ctx, 0, opProbe), model, "dimensions")
+	if err != nil {
+		return 0, err
+	}
+	if len(vec) == 0 {
+		return 0, fmt.Errorf("embedding model %q returned an empty vector", model)
+	}
+	return len(vec), nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatModel(t *testing.T) {
+	o := ModelOptions{Chat: "base", AllowedChat: []string{"big"}}
+	kb := kbSettings{ChatModel: "big"}
+
+	assert.Equal(t, "base", o.chatModel(nil, ""))
+	assert.Equal(t, "big", o.chatModel([]kbSettings{kb}, ""))
+	assert.Equal(t, "base", o.chatModel([]kbSettings{kb, kb}, ""), "several KBs use the default")
+	assert.Equal(t, "other", o.chatModel([]kbSettings{kb}, "other"), "the request wins")
+	assert.Equal(t, defaultChatModel, ModelOptions{}.chatModel(nil, ""))
+}
+
+func TestValidateChatModel(t *testing.T) {
+	o := ModelOptions{Chat: "base", AllowedChat: []string{"big"}}
+
+	assert.NoError(t, o.validateChatModel(""))
+	assert.NoError(t, o.validateChatModel("base"))
+	assert.NoError(t, o.validateChatModel("big"))
+	assert.EqualError(t, o.validateChatModel("huge"), `model "huge" is not allowed`)
+}
+
+func TestValidateQuestionRequestModels(t *testing.T) {
+	h := NewKBHandler(nil, nil)
+	h.Models = ModelOptions{Chat: "base"}
+	h.Prompt = PromptOptions{AnswerTokens: 100}
+	temp := func(v float32) *float32 { return &v }
+	tokens := func(v int) *int { return &v }
+
+	assert.Empty(t, h.validateQuestionRequest(questionRequest{Model: "base", Temperature: temp(0), MaxTokens: tokens(100)}))
+	assert.NotEmpty(t, h.validateQuestionRequest(questionRequest{Model: "other"}))
+	assert.NotEmpty(t, h.validateQuestionRequest(questionRequest{Temperature: temp(2.5)}))
+	assert.NotEmpty(t, h.validateQuestionRequest(questionRequest{MaxTokens: tokens(0)}))
+	assert.NotEmpty(t, h.validateQuestionRequest(questionRequest{MaxTokens: tokens(101)}))
+	negative := -0.2
+	assert.NotEmpty(t, h.validateQuestionRequest(questionRequest{MinSimilarity: &negative}))
+}
+
+func TestApiTemperature(t *testing.T) {
+	assert.Greater(t, apiTemperature(0), float32(0), "zero must not be omitted")
+	assert.Equal(t, float32(0.7), apiTemperature(0.7))
+}
+
+func TestEmbeddingDimensions(t *testing.T) {
+	ai := &recordingAI{emb: []float32{1, 0, 0}}
+	h := NewKBHandler(nil, ai)
+
+	n, err := h.embeddingDimensions(context.Background(), "text-embedding-3-large")
+	assert.NoError(t, err)
+	assert.Equal(t, 3072, n)
+	assert.Empty(t, ai.lastEmbInput, "known models are not probed")
+
+	n, err = h.embeddingDimensions(context.Background(), "local-model")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.NotEmpty(t, ai.lastEmbInput)
+}
+
+func TestCreateKBRejectsUnindexableModel(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// No statement may run: the KB must not be stored without its index.
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.CreateKB(w, conversationRequest(http.MethodPost, `{"name":"big","embedding_model":"text-embedding-3-large"}`, nil))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "3072 dimensions")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateKBRollsBackWithoutIndex(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO knowledge_bases").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	mock.ExpectExec("DROP INDEX IF EXISTS chunks_kb_7_embedding_idx").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE INDEX chunks_kb_7_embedding_idx").WillReturnError(errors.New("index failed"))
+	mock.ExpectRollback()
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.CreateKB(w, conversationRequest(http.MethodPost, `{"name":"kb"}`, nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateKBRollsBackWithoutIndex(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1 FROM knowledge_bases").WithArgs(int64(7), int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("FROM knowledge_bases WHERE id").WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "distance_metric", "system_prompt", "prompt_template",
+			"chat_model", "embedding_model", "embedding_dimensions", "content_version"}).
+			AddRow(7, "kb", "", "cosine", "", "", "", "text-embedding-ada-002", 1536, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE knowledge_bases SET name").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "distance_metric", "system_prompt", "prompt_template",
+			"chat_model", "embedding_model", "embedding_dimensions", "created_at"}).
+			AddRow(7, "kb", "", "l2", "", "", "", "text-embedding-ada-002", 1536, time.Now()))
+	mock.ExpectExec("DROP INDEX IF EXISTS chunks_kb_7_embedding_idx").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE INDEX chunks_kb_7_embedding_idx").WillReturnError(errors.New("index failed"))
+	mock.ExpectRollback()
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	h.UpdateKB(w, conversationRequest(http.MethodPatch, `{"distance_metric":"l2"}`, map[string]string{"kbID": "7"}))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// maxNeighbours bounds how many chunks on each side of a hit may be added to
+// its context window.
+const maxNeighbours = 5
+
+// contextPassage is a piece of context handed to the model. It covers one or
+// more retrieved hits, optionally widened with their neighbouring chunks in
+// the same file.
+type contextPassage struct {
+	KBID     int64
+	FileName string
+	FileSlug string
+	// First and Last are the chunk index range covered by the passage.
+	First, Last int
+	Text        string
+	// Hits are the retrieved chunks inside the window, reported as citations.
+	Hits []questionChunk
+
+	// sectionID is set when Text is a parent section rather than chunks.
+	sectionID int64
+}
+
+// passageWindows turns ranked hits into context windows spanning
+// chunk_index ± n. Overlapping or touching windows of the same file are merged.
+// Windows are ordered by the rank of their best hit.
+func passageWindows(hits []questionChunk, n int) []contextPassage {
+	type fileKey struct {
+		kbID       int64
+		name, slug string
+	}
+	byFile := map[fileKey][]int{}
+	var files []fileKey
+	for i, h := range hits {
+		k := fileKey{h.KBID, h.FileName, h.FileSlug}
+		if _, ok := byFile[k]; !ok {
+			files = append(files, k)
+		}
+		byFile[k] = append(byFile[k], i)
+	}
+
+	type window struct {
+		passage  contextPassage
+		bestRank int
+	}
+	var windows []window
+	for _, k := range files {
+		idx := byFile[k]
+		sort.SliceStable(idx, func(a, b int) bool { return hits[idx[a]].Index < hits[idx[b]].Index })
+		var cur *window
+		for _, i := range idx {
+			h := hits[i]
+			first, last := h.Index-n, h.Index+n
+			if first < 0 {
+				first = 0
+			}
+			if cur != nil && first <= cur.passage.Last+1 {
+				if last > cur.passage.Last {
+					cur.passage.Last = last
+				}
+				cur.passage.Hits = append(cur.passage.Hits, h)
+				if i < cur.bestRank {
+					cur.bestRank = i
+				}
+				continue
+			}
+			windows = append(windows, window{
+				passage: contextPassage{
+					KBID:     k.kbID,
+					FileName: k.name,
+					FileSlug: k.slug,
+					First:    first,
+					Last:     last,
+					Text:     h.Content,
+					Hits:     []questionChunk{h},
+				},
+				bestRank: i,
+			})
+			cur = &windows[len(windows)-1]
+		}
+	}
+	sort.SliceStable(windows, func(a, b int) bool { return windows[a].bestRank < windows[b].bestRank })
+
+	passages := make([]contextPassage, len(windows))
+	for i, w := range windows {
+		passages[i] = w.passage
+	}
+	return passages
+}
+
+// expandNeighbours builds the context passages for hits, widening each by n
+// chunks on either side. With n == 0 every hit is its own passage.
+func (h *KBHandler) expandNeighbours(ctx context.Context, hits []questionChunk, n int) ([]contextPassage, error) {
+	if n == 0 {
+		passages := make([]contextPassage, len(hits))
+		for i, hit := range hits {
+			passages[i] = contextPassage{
+				KBID:     hit.KBID,
+				FileName: hit.FileName,
+				FileSlug: hit.FileSlug,
+				First:    hit.Index,
+				Last:     hit.Index,
+				Text:     hit.Content,
+				Hits:     []questionChunk{hit},
+			}
+		}
+		return passages, nil
+	}
+	passages := passageWindows(hits, n)
+	for i := range passages {
+		p := &passages[i]
+		rows, err := h.DB.QueryContext(ctx,
+			`SELECT chunk_index, content FROM chunks
+			WHERE kb_id = $1 AND file_name = $2 AND lookup_name = $3 AND chunk_index BETWEEN $4 AND $5
+			ORDER BY chunk_index`,
+			p.KBID, p.FileName, p.FileSlug, p.First, p.Last,
+		)
+		if err != nil {
+			return nil, err
+		}
+		var parts []string
+		var indexes []int
+		for rows.Next() {
+			var index int
+			var content string
+			if err := rows.Scan(&index, &content); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			parts = append(parts, content)
+			indexes = append(indexes, index)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if len(parts) > 0 {
+			// Narrow the window to the chunks that exist near the file edges.
+			p.First, p.Last = indexes[0], indexes[len(indexes)-1]
+			p.Text = strings.Join(parts, " ")
+		}
+	}
+	return passages, nil
+}
+
+// buildPassages assembles the context for the prompt from ranked hits. Hits
+// that belong to a parent section are replaced by that section, once per
+// section; the remaining hits are widened by neighbours chunks. Passages are
+// kept in rank order while they fit into tokenBudget; a section that does not
+// fit is replaced by its hits alone. Passages that do not fit at all are
+// dropped together with their hits.
+func (h *KBHandler) buildPassages(ctx context.Context, hits []questionChunk, neighbours, tokenBudget int) ([]contextPassage, error) {
+	rank := map[chunkKey]int{}
+	sections := map[int64][]questionChunk{}
+	var sectionIDs []int64
+	var plain []questionChunk
+	for i, hit := range hits {
+		rank[keyOf(hit)] = i
+		if hit.sectionID == 0 {
+			plain = append(plain, hit)
+			continue
+		}
+		if _, ok := sections[hit.sectionID]; !ok {
+			sectionIDs = append(sectionIDs, hit.sectionID)
+		}
+		sections[hit.sectionID] = append(sections[hit.sectionID], hit)
+	}
+
+	passages, err := h.expandNeighbours(ctx, plain, neighbours)
+	if err != nil {
+		return nil, err
+	}
+	if len(sectionIDs) > 0 {
+		rows, err := h.DB.QueryContext(ctx, `SELECT id, content FROM sections WHERE id = ANY($1)`, pq.Array(sectionIDs))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var content string
+			if err := rows.Scan(&id, &content); err != nil {
+				return nil, err
+			}
+			secHits := sections[id]
+			first, last := secHits[0].Index, secHits[0].Index
+			for _, hit := range secHits {
+				first = min(first, hit.Index)
+				last = max(last, hit.Index)
+			}
+			passages = append(passages, contextPassage{
+				KBID:      secHits[0].KBID,
+				FileName:  secHits[0].FileName,
+				FileSlug:  secHits[0].FileSlug,
+				First:     first,
+				Last:      last,
+				Text:      content,
+				Hits:      secHits,
+				sectionID: id,
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	bestRank := func(p contextPassage) int {
+		best := len(hits)
+		for _, hit := range p.Hits {
+			best = min(best, rank[keyOf(hit)])
+		}
+		return best
+	}
+	sort.SliceStable(passages, func(a, b int) bool { return bestRank(passages[a]) < bestRank(passages[b]) })
+	return packPassages(passages, tokenBudget), nil
+}
+
+// packPassages keeps passages in order while their text, numbered for the
+// prompt, fits into budget tokens. A section passage that does not fit is
+// retried with the text of its hits only. A non-positive budget keeps
+// everything.
+func packPassages(passages []contextPassage, budget int) []contextPassage {
+	if budget <= 0 {
+		return passages
+	}
+	var packed []contextPassage
+	used := 0
+	for _, p := range passages {
+		cost := utils.CountTokens(p.Text) + passageOverheadTokens
+		if used+cost > budget && p.sectionID != 0 {
+			parts := make([]string, len(p.Hits))
+			for i, hit := range p.Hits {
+				parts[i] = hit.Content
+			}
+			p.Text = strings.Join(parts, "\n...\n")
+			cost = utils.CountTokens(p.Text) + passageOverheadTokens
+		}
+		if used+cost > budget {
+			continue
+		}
+		used += cost
+		packed = append(packed, p)
+	}
+	return packed
+}
+
+// chunkKey identifies a retrieved chunk.
+type chunkKey struct {
+	kbID       int64
+	name, slug string
+	index      int
+}
+
+func keyOf(c questionChunk) chunkKey {
+	return chunkKey{c.KBID, c.FileName, c.FileSlug, c.Index}
+}
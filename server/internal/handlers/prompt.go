@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	// defaultContextWindow is the context size of gpt-3.5-turbo.
+	defaultContextWindow = 16385
+	defaultAnswerTokens  = 1024
+	defaultHistoryTokens = 1000
+
+	// messageOverheadTokens is what the chat format adds around each message.
+	messageOverheadTokens = 4
+	// passageOverheadTokens is the cost of a passage's "[n] " label and the
+	// "---" separator in front of it.
+	passageOverheadTokens = 6
+
+	defaultSystemPrompt = "You are a helpful assistant."
+	// answerInstructions ask for the citations parseCitations resolves and
+	// for no guessing without context. Custom templates get them appended.
+	answerInstructions = "Cite the passages you use by their number in square brackets, e.g. [1]. " +
+		"If the context does not contain the answer, say so instead of guessing."
+	defaultPromptTemplate = "Answer the question based on the following context. " + answerInstructions + "\n\n" +
+		"{{context}}\n\n" + questionLabel + "{{question}}"
+
+	// noContextAnswer is the answer to questions no chunk is relevant to,
+	// given without asking the chat model.
+	noContextAnswer = "I could not find anything relevant to this question in the knowledge base."
+
+	// maxPromptLength bounds the length of a KB's custom prompts.
+	maxPromptLength = 4000
+)
+
+// Labels and requests of the rerank and grounding prompts.
+const (
+	// questionLabel precedes the question in the answer and rerank prompts.
+	questionLabel = "Question: "
+	// passagesLabel precedes the numbered passages of the rerank and
+	// grounding prompts.
+	passagesLabel = "Passages:"
+	// claimsLabel precedes the numbered claims of the grounding prompt.
+	claimsLabel = "Claims:"
+	// scoresRequest ends the rerank prompt; %d is the number of passages.
+	scoresRequest = "Return only a JSON array of %d numbers, one per passage in order."
+	// verdictsRequest ends the grounding prompt; %d is the number of claims.
+	verdictsRequest = "Return only a JSON array of %d numbers, one per claim in order: 1 if the passages support the claim, 0 if not."
+)
+
+// placeholderPattern matches template placeholders such as {{kb_name}}.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// promptPlaceholders are the placeholders a prompt template may use.
+var promptPlaceholders = map[string]bool{"context": true, "question": true, "kb_name": true, "date": true}
+
+// PromptOptions sizes the prompts sent to the chat model so that they fit its
+// context window. Zero values fall back to the defaults.
+type PromptOptions struct {
+	// ContextWindow is the number of tokens the chat model accepts for the
+	// prompt and the answer together.
+	ContextWindow int
+	// AnswerTokens is reserved for the answer and caps its length.
+	AnswerTokens int
+	// HistoryTokens bounds the conversation history used to rewrite
+	// follow-up questions; older messages are dropped first.
+	HistoryTokens int
+}
+
+func (o PromptOptions) withDefaults() PromptOptions {
+	if o.ContextWindow <= 0 {
+		o.ContextWindow = defaultContextWindow
+	}
+	if o.AnswerTokens <= 0 {
+		o.AnswerTokens = defaultAnswerTokens
+	}
+	if o.HistoryTokens <= 0 {
+		o.HistoryTokens = defaultHistoryTokens
+	}
+	return o
+}
+
+// promptTemplate is the pair of prompts used to ask the chat model for an
+// answer. System is sent as the system message and User, with the retrieved
+// context, as the user message. Both may use the placeholders {{context}},
+// {{question}}, {{kb_name}} and {{date}}.
+type promptTemplate struct {
+	System string
+	User   string
+}
+
+// promptFor returns the prompts of a single knowledge base, falling back to
+// the defaults for prompts it does not customise. A custom template is
+// followed by the answerInstructions. Answers drawn from several KBs always
+// use the defaults.
+func promptFor(kbs []kbSettings) promptTemplate {
+	t := promptTemplate{System: defaultSystemPrompt, User: defaultPromptTemplate}
+	if len(kbs) != 1 {
+		return t
+	}
+	if kbs[0].SystemPrompt != "" {
+		t.System = kbs[0].SystemPrompt
+	}
+	if kbs[0].PromptTemplate != "" {
+		t.User = kbs[0].PromptTemplate + "\n\n" + answerInstructions
+	}
+	return t
+}
+
+// promptValues are the values substituted for the template placeholders.
+type promptValues struct {
+	Context  string
+	Question string
+	KBName   string
+	Date     string
+}
+
+// messages renders the template into chat messages. Placeholders are
+// replaced in a single pass, so placeholders inside the values are kept
+// verbatim.
+func (t promptTemplate) messages(v promptValues) []go_openai.ChatCompletionMessage {
+	values := map[string]string{"context": v.Context, "question": v.Question, "kb_name": v.KBName, "date": v.Date}
+	fill := func(s string) string {
+		return placeholderPattern.ReplaceAllStringFunc(s, func(m string) string {
+			return values[placeholderPattern.FindStringSubmatch(m)[1]]
+		})
+	}
+	return []go_openai.ChatCompletionMessage{
+		{Role: "system", Content: fill(t.System)},
+		{Role: "user", Content: fill(t.User)},
+	}
+}
+
+// validatePrompt checks a custom system prompt and answer template before
+// they are saved. Empty prompts select the defaults. A template must place the
+// question and, exactly once, the context; the system prompt must not contain
+// the context, which is budgeted for the template only.
+func validatePrompt(system, template string) error {
+	uses := map[string]map[string]int{}
+	for _, p := range []struct{ field, text string }{{"system_prompt", system}, {"prompt_template", template}} {
+		if len(p.text) > maxPromptLength {
+			return fmt.Errorf("%s must be at most %d characters", p.field, maxPromptLength)
+		}
+		matches := placeholderPattern.FindAllStringSubmatch(p.text, -1)
+		uses[p.field] = map[string]int{}
+		for _, m := range matches {
+			if !promptPlaceholders[m[1]] {
+				return fmt.Errorf("%s uses unknown placeholder %s (expected {{context}}, {{question}}, {{kb_name}} or {{date}})", p.field, m[0])
+			}
+			uses[p.field][m[1]]++
+		}
+		if strings.Count(p.text, "{{") != len(matches) {
+			return fmt.Errorf("%s has a malformed placeholder", p.field)
+		}
+	}
+	if uses["system_prompt"]["context"] > 0 {
+		return fmt.Errorf("system_prompt must not contain {{context}}")
+	}
+	if template != "" {
+		if uses["prompt_template"]["context"] != 1 {
+			return fmt.Errorf("prompt_template must contain {{context}} exactly once")
+		}
+		if uses["prompt_template"]["question"] == 0 {
+			return fmt.Errorf("prompt_template must contain {{question}}")
+		}
+	}
+	return nil
+}
+
+// contextBudget returns how many tokens of context passages fit into the
+// answer prompt, capped at maxContext. v carries everything but the context.
+// It fails when the prompt alone leaves no room for context.
+func (o PromptOptions) contextBudget(t promptTemplate, v promptValues, maxContext int) (int, error) {
+	o = o.withDefaults()
+	v.Context = ""
+	fixed := 0
+	for _, m := range t.messages(v) {
+		fixed += utils.CountTokens(m.Content) + messageOverheadTokens
+	}
+	available := o.ContextWindow - o.AnswerTokens - fixed
+	if available <= 0 {
+		return 0, fmt.Errorf("question is too long: %d tokens of prompt leave no room for context", fixed)
+	}
+	return min(available, maxContext), nil
+}
+
+// trimHistory keeps the most recent messages of history whose tokens fit into
+// budget. When even the latest message does not fit, it is truncated.
+func trimHistory(history []chatMessage, budget int) []chatMessage {
+	used := 0
+	start := len(history)
+	for start > 0 {
+		cost := utils.CountTokens(history[start-1].Content) + messageOverheadTokens
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		start--
+	}
+	if start == len(history) && len(history) > 0 {
+		last := history[len(history)-1]
+		last.Content = utils.TruncateTokens(last.Content, budget-messageOverheadTokens)
+		if last.Content == "" {
+			return nil
+		}
+		return []chatMessage{last}
+	}
+	return history[start:]
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimHistoryKeepsRecentMessages(t *testing.T) {
+	history := []chatMessage{
+		{Role: "user", Content: strings.Repeat("old ", 20)},
+		{Role: "assistant", Content: "older answer"},
+		{Role: "user", Content: "recent question"},
+		{Role: "assistant", Content: "recent answer"},
+	}
+	// The recent messages cost three and two tokens plus the message overhead.
+	assert.Equal(t, history[2:], trimHistory(history, 5+2*messageOverheadTokens))
+	assert.Equal(t, history, trimHistory(history, 1000))
+}
+
+func TestTrimHistoryTruncatesLongLastMessage(t *testing.T) {
+	history := []chatMessage{{Role: "user", Content: strings.Repeat("word ", 100)}}
+	trimmed := trimHistory(history, 10+messageOverheadTokens)
+	if assert.Len(t, trimmed, 1) {
+		assert.Equal(t, strings.TrimSpace(strings.Repeat("word ", 10)), trimmed[0].Content)
+	}
+	assert.Empty(t, trimHistory(history, messageOverheadTokens))
+}
+
+func TestContextBudget(t *testing.T) {
+	opts := PromptOptions{ContextWindow: 2000, AnswerTokens: 500}
+	tmpl := promptFor(nil)
+	budget, err := opts.contextBudget(tmpl, promptValues{Question: "short question"}, 3000)
+	assert.NoError(t, err)
+	assert.Less(t, budget, 1500)
+	assert.Greater(t, budget, 1400)
+
+	budget, err = opts.contextBudget(tmpl, promptValues{Question: "short question"}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, budget)
+
+	_, err = opts.contextBudget(tmpl, promptValues{Question: strings.Repeat("word ", 2000)}, 3000)
+	assert.Error(t, err)
+}
+
+func TestDefaultPromptMessages(t *testing.T) {
+	msgs := promptFor(nil).messages(promptValues{
+		Context:  numberedContext([]contextPassage{{Text: "alpha"}, {Text: "bravo"}}),
+		Question: "what is alpha?",
+	})
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, defaultSystemPrompt, msgs[0].Content)
+		assert.Contains(t, msgs[1].Content, "[1] alpha\n---\n[2] bravo")
+		assert.True(t, strings.HasSuffix(msgs[1].Content, "Question: what is alpha?"))
+	}
+}
+
+func TestKBPromptMessages(t *testing.T) {
+	kb := kbSettings{
+		Name:           "Runbooks",
+		SystemPrompt:   "You write terse numbered steps for {{kb_name}}. Today is {{date}}.",
+		PromptTemplate: "Steps for: {{ question }}\nSources:\n{{context}}",
+	}
+	msgs := promptFor([]kbSettings{kb}).messages(promptValues{
+		Context:  "[1] use {{question}} literally",
+		Question: "restart the API",
+		KBName:   "Runbooks",
+		Date:     "2026-10-19",
+	})
+	assert.Equal(t, "You write terse numbered steps for Runbooks. Today is 2026-10-19.", msgs[0].Content)
+	assert.Equal(t, "Steps for: restart the API\nSources:\n[1] use {{question}} literally\n\n"+answerInstructions, msgs[1].Content,
+		"custom templates keep the citation and no-context instructions")
+
+	// Answers across several KBs use the default prompt.
+	assert.Equal(t, defaultSystemPrompt, promptFor([]kbSettings{kb, kb}).System)
+}
+
+func TestValidatePrompt(t *testing.T) {
+	assert.NoError(t, validatePrompt("", ""))
+	assert.NoError(t, validatePrompt("Answer formally for {{kb_name}}.", "{{context}}\n\nQ: {{question}} ({{date}})"))
+
+	for _, tc := range []struct{ system, template, msg string }{
+		{"", "{{context}}", "prompt_template must contain {{question}}"},
+		{"", "{{question}}", "prompt_template must contain {{context}} exactly once"},
+		{"", "{{context}} {{context}} {{question}}", "prompt_template must contain {{context}} exactly once"},
+		{"{{context}}", "", "system_prompt must not contain {{context}}"},
+		{"Hi {{user}}", "", "system_prompt uses unknown placeholder {{user}}"},
+		{"", "{{context}} {{question}} {{date", "prompt_template has a malformed placeholder"},
+		{strings.Repeat("x", maxPromptLength+1), "", "system_prompt must be at most"},
+	} {
+		err := validatePrompt(tc.system, tc.template)
+		if assert.Error(t, err, tc.msg) {
+			assert.Contains(t, err.Error(), tc.msg)
+		}
+	}
+}
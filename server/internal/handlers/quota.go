@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zkiss/kb-codex/internal/config"
+)
+
+// Quota is a set of monthly limits, or the usage counted against them.
+type Quota = config.Quota
+
+// limitOverrides are the limits an admin set for a user or KB. Unset limits
+// fall back to the configured default for users and are unlimited for KBs.
+type limitOverrides struct {
+	Tokens      *int64 `json:"tokens"`
+	UploadBytes *int64 `json:"upload_bytes"`
+	Questions   *int64 `json:"questions"`
+}
+
+// apply returns def with the overridden limits replaced.
+func (o limitOverrides) apply(def Quota) Quota {
+	if o.Tokens != nil {
+		def.Tokens = *o.Tokens
+	}
+	if o.UploadBytes != nil {
+		def.UploadBytes = *o.UploadBytes
+	}
+	if o.Questions != nil {
+		def.Questions = *o.Questions
+	}
+	return def
+}
+
+// quotaScope names the limits of a user or of a KB: their table, the column
+// identifying them in the limits and uploads tables, and the condition
+// selecting the AI calls counting against them.
+type quotaScope struct {
+	table   string
+	column  string
+	charged string
+}
+
+var (
+	userQuota = quotaScope{table: "user_limits", column: "user_id", charged: "user_id = $1"}
+	// An answer across several KBs counts against each of them.
+	kbQuota = quotaScope{table: "kb_limits", column: "kb_id", charged: "kb_ids @> ARRAY[$1::integer]"}
+)
+
+// monthStart returns the start of the UTC calendar month of t, when quotas
+// reset.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// loadOverrides reads the limits an admin set for the user or KB id.
+func loadOverrides(ctx context.Context, db *sql.DB, scope quotaScope, id int64) (limitOverrides, error) {
+	var tokens, uploadBytes, questions sql.NullInt64
+	err := db.QueryRowContext(ctx,
+		`SELECT tokens, upload_bytes, questions FROM `+scope.table+` WHERE `+scope.column+` = $1`, id,
+	).Scan(&tokens, &uploadBytes, &questions)
+	if err == sql.ErrNoRows {
+		return limitOverrides{}, nil
+	}
+	if err != nil {
+		return limitOverrides{}, err
+	}
+	var o limitOverrides
+	if tokens.Valid {
+		o.Tokens = &tokens.Int64
+	}
+	if uploadBytes.Valid {
+		o.UploadBytes = &uploadBytes.Int64
+	}
+	if questions.Valid {
+		o.Questions = &questions.Int64
+	}
+	return o, nil
+}
+
+// monthlyUsage sums the usage of the user or KB id since the given time.
+// Every answer, generated or cached, counts as a question.
+func monthlyUsage(ctx context.Context, db *sql.DB, scope quotaScope, id int64, since time.Time) (Quota, error) {
+	var used Quota
+	err := db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(prompt_tokens + completion_tokens), 0), COUNT(*) FILTER (WHERE operation = $3)
+		FROM ai_usage WHERE `+scope.charged+` AND created_at >= $2`,
+		id, since, opAnswer,
+	).Scan(&used.Tokens, &used.Questions)
+	if err != nil {
+		return Quota{}, err
+	}
+	err = db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(bytes), 0) FROM uploads WHERE `+scope.column+` = $1 AND created_at >= $2`,
+		id, since,
+	).Scan(&used.UploadBytes)
+	if err != nil {
+		return Quota{}, err
+	}
+	return used, nil
+}
+
+// exceededLimit returns the name, limit and usage of the first limit that a
+// request needing need would exceed. Tokens are only known once spent, so
+// the token limit is exceeded when it is used up.
+func exceededLimit(limits, used, need Quota) (name string, limit, usage int64, exceeded bool) {
+	switch {
+	case limits.Tokens > 0 && used.Tokens >= limits.Tokens:
+		return "tokens", limits.Tokens, used.Tokens, true
+	case limits.UploadBytes > 0 && need.UploadBytes > 0 && used.UploadBytes+need.UploadBytes > limits.UploadBytes:
+		return "upload_bytes", limits.UploadBytes, used.UploadBytes, true
+	case limits.Questions > 0 && need.Questions > 0 && used.Questions+need.Questions > limits.Questions:
+		return "questions", limits.Questions, used.Questions, true
+	}
+	return "", 0, 0, false
+}
+
+// quotaExceeded is the body of a 429 response to a request over quota.
+type quotaExceeded struct {
+	Error    string    `json:"error"`
+	KBID     int64     `json:"kb_id,omitempty"`
+	Quota    string    `json:"quota"`
+	Limit    int64     `json:"limit"`
+	Used     int64     `json:"used"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// checkQuota enforces the monthly limits of the user and of the KBs a
+// request uses before it calls the AI client. When the request needing need
+// would exceed a limit it responds 429 and returns false.
+func (h *KBHandler) checkQuota(w http.ResponseWriter, r *http.Request, userID int64, kbIDs []int64, need Quota) bool {
+	now := time.Now()
+	since := monthStart(now)
+	resets := since.AddDate(0, 1, 0)
+
+	check := func(scope quotaScope, id int64, def Quota) (bool, error) {
+		o, err := loadOverrides(r.Context(), h.DB, scope, id)
+		if err != nil {
+			return false, err
+		}
+		limits := o.apply(def)
+		if limits == (Quota{}) {
+			return true, nil
+		}
+		used, err := monthlyUsage(r.Context(), h.DB, scope, id, since)
+		if err != nil {
+			return false, err
+		}
+		name, limit, usage, exceeded := exceededLimit(limits, used, need)
+		if !exceeded {
+			return true, nil
+		}
+		body := quotaExceeded{Quota: name, Limit: limit, Used: usage, ResetsAt: resets}
+		owner := "your"
+		if scope == kbQuota {
+			body.KBID = id
+			owner = fmt.Sprintf("knowledge base %d's", id)
+		}
+		body.Error = fmt.Sprintf("%s monthly %s quota is exceeded (%d of %d used); it resets on %s",
+			owner, name, usage, limit, resets.Format(time.DateOnly))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(int(resets.Sub(now).Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(body)
+		return false, nil
+	}
+
+	ok, err := check(userQuota, userID, h.Quota)
+	for _, kbID := range kbIDs {
+		if !ok || err != nil {
+			break
+		}
+		ok, err = check(kbQuota, kbID, Quota{})
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return false
+	}
+	return ok
+}
+
+// recordUpload counts an uploaded file towards the upload quota.
+func (h *KBHandler) recordUpload(ctx context.Context, userID, kbID int64, fileName string, size int) error {
+	_, err := h.DB.ExecContext(ctx,
+		`INSERT INTO uploads(user_id, kb_id, file_name, bytes) VALUES ($1, $2, $3, $4)`,
+		userID, kbID, fileName, size,
+	)
+	return err
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExceededLimit(t *testing.T) {
+	limits := Quota{Tokens: 100, UploadBytes: 1000, Questions: 10}
+
+	_, _, _, exceeded := exceededLimit(limits, Quota{Tokens: 99, UploadBytes: 500, Questions: 9}, Quota{Questions: 1})
+	assert.False(t, exceeded)
+
+	name, limit, used, exceeded := exceededLimit(limits, Quota{Tokens: 100}, Quota{Questions: 1})
+	assert.True(t, exceeded)
+	assert.Equal(t, "tokens", name)
+	assert.Equal(t, int64(100), limit)
+	assert.Equal(t, int64(100), used)
+
+	name, _, _, exceeded = exceededLimit(limits, Quota{UploadBytes: 500}, Quota{UploadBytes: 501})
+	assert.True(t, exceeded)
+	assert.Equal(t, "upload_bytes", name)
+
+	name, _, _, exceeded = exceededLimit(limits, Quota{Questions: 10}, Quota{Questions: 1})
+	assert.True(t, exceeded)
+	assert.Equal(t, "questions", name)
+
+	_, _, _, exceeded = exceededLimit(limits, Quota{Questions: 10}, Quota{UploadBytes: 1})
+	assert.False(t, exceeded, "only the limits a request needs apply")
+	_, _, _, exceeded = exceededLimit(Quota{}, Quota{Tokens: 1e9, Questions: 1e9}, Quota{Questions: 1})
+	assert.False(t, exceeded, "zero limits are unlimited")
+}
+
+func TestMonthStart(t *testing.T) {
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), monthStart(time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC)))
+}
+
+func TestCheckQuota(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// The user has no overrides and is within the default limits; the KB's
+	// question limit is reached.
+	mock.ExpectQuery("FROM user_limits").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "upload_bytes", "questions"}))
+	mock.ExpectQuery("FROM ai_usage").WithArgs(int64(1), sqlmock.AnyArg(), opAnswer).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "questions"}).AddRow(10, 2))
+	mock.ExpectQuery("FROM uploads").WithArgs(int64(1), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"bytes"}).AddRow(0))
+	mock.ExpectQuery("FROM kb_limits").WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "upload_bytes", "questions"}).AddRow(nil, nil, 2))
+	mock.ExpectQuery(`FROM ai_usage WHERE kb_ids @> ARRAY\[\$1::integer\]`).WithArgs(int64(7), sqlmock.AnyArg(), opAnswer).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "questions"}).AddRow(10, 2))
+	mock.ExpectQuery("FROM uploads").WithArgs(int64(7), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"bytes"}).AddRow(0))
+
+	h := NewKBHandler(db, nil)
+	h.Quota = Quota{Tokens: 1000, Questions: 100}
+	w := httptest.NewRecorder()
+	ok := h.checkQuota(w, conversationRequest(http.MethodPost, "", nil), 1, []int64{7}, Quota{Questions: 1})
+
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var body quotaExceeded
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, quotaExceeded{
+		Error:    body.Error,
+		KBID:     7,
+		Quota:    "questions",
+		Limit:    2,
+		Used:     2,
+		ResetsAt: monthStart(time.Now()).AddDate(0, 1, 0),
+	}, body)
+	assert.Contains(t, body.Error, "knowledge base 7")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckQuotaUnlimited(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// Without limits the usage is not summed up.
+	mock.ExpectQuery("FROM user_limits").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "upload_bytes", "questions"}))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	assert.True(t, h.checkQuota(w, conversationRequest(http.MethodPost, "", nil), 1, nil, Quota{Questions: 1}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// Reranker reorders retrieved chunks by their relevance to the question. It
+// returns the chunks most relevant first, with Relevance set to a score in
+// [0, 1]. model is the chat model answering the question, which rerankers
+// asking a chat model use.
+type Reranker interface {
+	Rerank(ctx context.Context, model, question string, chunks []questionChunk) ([]questionChunk, error)
+}
+
+// NewReranker returns the reranker registered under name: "llm" scores
+// candidates with the given chat model and falls back to "lexical" (BM25) when
+// the model call fails. An empty name or "none" disables reranking.
+func NewReranker(name string, client AIClient, model string) (Reranker, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return nil, nil
+	case "lexical":
+		return LexicalReranker{}, nil
+	case "llm":
+		return &LLMReranker{AI: client, Model: model, Fallback: LexicalReranker{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown reranker %q (expected none, lexical or llm)", name)
+	}
+}
+
+// LexicalReranker orders chunks by BM25 term overlap with the question, using
+// the candidate set as the corpus. Ties keep the vector search order.
+type LexicalReranker struct{}
+
+// Rerank implements Reranker.
+func (LexicalReranker) Rerank(_ context.Context, _, question string, chunks []questionChunk) ([]questionChunk, error) {
+	docs := make([][]string, len(chunks))
+	for i, c := range chunks {
+		docs[i] = utils.Tokenize(c.Content)
+	}
+	// BM25 scores have no fixed scale, so they are relative to the best.
+	scores := utils.BM25Scores(utils.Tokenize(question), docs)
+	var best float64
+	for _, s := range scores {
+		best = max(best, s)
+	}
+	relevance := make([]float64, len(scores))
+	for i, s := range scores {
+		if best > 0 && s > 0 {
+			relevance[i] = s / best
+		}
+	}
+	return sortByRelevance(chunks, relevance), nil
+}
+
+// LLMReranker asks the chat model to grade each candidate's relevance. When
+// the call fails or the reply cannot be parsed the Fallback reranker is used.
+type LLMReranker struct {
+	AI AIClient
+	// Model is the chat model grading the candidates when Rerank is given
+	// none; empty selects the default chat model.
+	Model    string
+	Fallback Reranker
+}
+
+const (
+	// rerankPassageLength bounds the text of each candidate sent to the
+	// model.
+	rerankPassageLength = 300
+	// rerankBatchTokens bounds the passages of a single rerank prompt, so
+	// that large candidate sets are scored in several calls rather than
+	// overflowing the model's context window.
+	rerankBatchTokens = 2000
+	// maxRerankScore is the score of a passage answering the question
+	// directly.
+	maxRerankScore = 10
+)
+
+// Rerank implements Reranker.
+func (r *LLMReranker) Rerank(ctx context.Context, model, question string, chunks []questionChunk) ([]questionChunk, error) {
+	if len(chunks) == 0 {
+		return chunks, nil
+	}
+	if model == "" {
+		model = r.Model
+	}
+	scores, err := r.score(ctx, model, question, chunks)
+	if err != nil {
+		if r.Fallback == nil {
+			return nil, err
+		}
+		return r.Fallback.Rerank(ctx, model, question, chunks)
+	}
+	// The scores are kept on their absolute scale, so that candidates that
+	// are all irrelevant stay irrelevant.
+	relevance := make([]float64, len(scores))
+	for i, s := range scores {
+		relevance[i] = min(max(s/maxRerankScore, 0), 1)
+	}
+	return sortByRelevance(chunks, relevance), nil
+}
+
+// rerankPrompt asks for a relevance score of each passage for question.
+func rerankPrompt(question string, passages []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%s\n\n%s\n", questionLabel, question, passagesLabel)
+	for i, p := range passages {
+		fmt.Fprintf(&b, "[%d] %s\n", i+1, p)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, scoresRequest, len(passages))
+	return b.String()
+}
+
+// score rates every chunk from 0 to maxRerankScore, asking the model about
+// batches of at most rerankBatchTokens of passages at a time.
+func (r *LLMReranker) score(ctx context.Context, model, question string, chunks []questionChunk) ([]float64, error) {
+	var scores []float64
+	var batch []string
+	tokens := 0
+	for i, c := range chunks {
+		passage := utils.Snippet(c.Content, rerankPassageLength)
+		batch = append(batch, passage)
+		tokens += utils.CountTokens(passage)
+		if next := i + 1; next < len(chunks) && tokens+utils.CountTokens(utils.Snippet(chunks[next].Content, rerankPassageLength)) <= rerankBatchTokens {
+			continue
+		}
+		batchScores, err := r.scoreBatch(ctx, model, question, batch)
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, batchScores...)
+		batch, tokens = nil, 0
+	}
+	return scores, nil
+}
+
+// scoreBatch asks the model to rate passages in a single call.
+func (r *LLMReranker) scoreBatch(ctx context.Context, model, question string, passages []string) ([]float64, error) {
+	ctx = ai.WithInputs(ai.WithOperation(ctx, ai.OpRerank), ai.Inputs{Question: question, Passages: passages})
+	resp, err := r.AI.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Model: ModelOptions{Chat: model}.withDefaults().Chat,
+		Messages: []go_openai.ChatCompletionMessage{
+			{Role: "system", Content: "Rate how useful each passage is for answering the question on a scale from 0 (irrelevant) to 10 (answers it directly)."},
+			{Role: "user", Content: rerankPrompt(question, passages)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no completion returned")
+	}
+	scores, err := utils.ParseNumbers(resp.Choices[0].Message.Content, len(passages))
+	if err != nil {
+		return nil, fmt.Errorf("invalid reranker reply: %w", err)
+	}
+	return scores, nil
+}
+
+// sortByRelevance returns the chunks ordered by descending relevance, with
+// Relevance set. The sort is stable so equal scores keep their incoming
+// order.
+func sortByRelevance(chunks []questionChunk, relevance []float64) []questionChunk {
+	out := make([]questionChunk, len(chunks))
+	copy(out, chunks)
+	for i := range out {
+		out[i].Relevance = relevance[i]
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Relevance > out[b].Relevance })
+	return out
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+)
+
+// chatStubAI answers every chat completion with a fixed reply.
+type chatStubAI struct {
+	reply string
+	err   error
+	calls int
+	// models are the models of the chat requests made.
+	models []string
+}
+
+func (c *chatStubAI) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	return go_openai.EmbeddingResponse{}, errors.New("not implemented")
+}
+
+func (c *chatStubAI) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	c.calls++
+	c.models = append(c.models, req.Model)
+	if c.err != nil {
+		return go_openai.ChatCompletionResponse{}, c.err
+	}
+	return go_openai.ChatCompletionResponse{Choices: []go_openai.ChatCompletionChoice{{Message: go_openai.ChatCompletionMessage{Content: c.reply}}}}, nil
+}
+
+func (c *chatStubAI) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ChatStream, error) {
+	c.calls++
+	c.models = append(c.models, req.Model)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &staticStream{deltas: []string{c.reply}}, nil
+}
+
+func rerankCandidates() []questionChunk {
+	return []questionChunk{
+		{FileName: "a.md", Index: 0, Content: "office opening hours"},
+		{FileName: "b.md", Index: 0, Content: "how to restart the database server"},
+		{FileName: "c.md", Index: 0, Content: "database backup schedule"},
+	}
+}
+
+func TestLexicalReranker(t *testing.T) {
+	out, err := LexicalReranker{}.Rerank(context.Background(), "", "restart database", rerankCandidates())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.md", "c.md", "a.md"}, []string{out[0].FileName, out[1].FileName, out[2].FileName})
+	assert.Equal(t, 1.0, out[0].Relevance)
+	assert.Equal(t, 0.0, out[2].Relevance)
+}
+
+func TestLLMReranker(t *testing.T) {
+	ai := &chatStubAI{reply: "Scores: [2, 0, 10]"}
+	r := &LLMReranker{AI: ai, Model: "rerank-model", Fallback: LexicalReranker{}}
+	out, err := r.Rerank(context.Background(), "", "restart database", rerankCandidates())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ai.calls)
+	assert.Equal(t, []string{"rerank-model"}, ai.models)
+	assert.Equal(t, []string{"c.md", "a.md", "b.md"}, []string{out[0].FileName, out[1].FileName, out[2].FileName})
+	assert.InDelta(t, 0.2, out[1].Relevance, 1e-9)
+
+	// The model answering the question is used when given.
+	_, err = r.Rerank(context.Background(), "kb-model", "restart database", rerankCandidates())
+	assert.NoError(t, err)
+	assert.Equal(t, "kb-model", ai.models[1])
+}
+
+// passageStubAI scores every passage of a rerank prompt with score.
+type passageStubAI struct {
+	chatStubAI
+	score   int
+	batches []int
+}
+
+func (p *passageStubAI) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	n := len(ai.InputsOf(ctx).Passages)
+	p.batches = append(p.batches, n)
+	scores := strings.TrimSuffix(strings.Repeat(strconv.Itoa(p.score)+", ", n), ", ")
+	p.reply = "[" + scores + "]"
+	return p.chatStubAI.CreateChatCompletion(ctx, req)
+}
+
+func TestLLMRerankerBatches(t *testing.T) {
+	var chunks []questionChunk
+	for i := range 40 {
+		chunks = append(chunks, questionChunk{FileName: "f.md", Index: i, Content: strings.Repeat("lorem ipsum dolor sit amet ", 20)})
+	}
+	stub := &passageStubAI{score: 1}
+	out, err := (&LLMReranker{AI: stub}).Rerank(context.Background(), "", "restart database", chunks)
+	assert.NoError(t, err)
+	assert.Len(t, out, 40)
+	assert.Greater(t, len(stub.batches), 1)
+	total := 0
+	for _, n := range stub.batches {
+		total += n
+	}
+	assert.Equal(t, 40, total)
+	// Uniformly poor scores stay poor rather than being scaled up to 1.
+	for _, c := range out {
+		assert.InDelta(t, 0.1, c.Relevance, 1e-9)
+	}
+}
+
+func TestLLMRerankerFallback(t *testing.T) {
+	for _, ai := range []*chatStubAI{{reply: "[1, 2]"}, {reply: "no idea"}, {err: errors.New("boom")}} {
+		r := &LLMReranker{AI: ai, Fallback: LexicalReranker{}}
+		out, err := r.Rerank(context.Background(), "", "restart database", rerankCandidates())
+		assert.NoError(t, err)
+		assert.Equal(t, "b.md", out[0].FileName)
+	}
+
+	_, err := (&LLMReranker{AI: &chatStubAI{reply: "nope"}}).Rerank(context.Background(), "", "q", rerankCandidates())
+	assert.Error(t, err)
+}
+
+func TestNewReranker(t *testing.T) {
+	r, err := NewReranker("", nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	r, err = NewReranker("LLM", nil, "")
+	assert.NoError(t, err)
+	assert.IsType(t, &LLMReranker{}, r)
+
+	_, err = NewReranker("magic", nil, "")
+	assert.Error(t, err)
+}
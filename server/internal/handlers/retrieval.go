@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	defaultRetrievalCandidates = 50
+	defaultRetrievalTopK       = 5
+	defaultMMRLambda           = 0.7
+	defaultContextTokens       = 3000
+)
+
+// RetrievalOptions tunes how AskQuestion selects the chunks packed into the
+// prompt. Zero values fall back to the defaults.
+type RetrievalOptions struct {
+	// Candidates is the number of nearest chunks fetched from the vector index
+	// before reranking.
+	Candidates int
+	// TopK is the number of chunks kept after reranking.
+	TopK int
+	// MMRLambda trades relevance (1) against diversity (0) when picking the
+	// top chunks by maximal marginal relevance. 1 disables diversification.
+	MMRLambda float64
+	// Neighbours widens each retrieved chunk with this many adjacent chunks
+	// of the same file on either side before it is put into the prompt.
+	Neighbours int
+	// ContextTokens is the token budget for the context passages in the
+	// prompt.
+	ContextTokens int
+	// Mode is RetrievalModeChunks to search all chunks of the KB, or
+	// RetrievalModeTwoStage to first pick Documents files by the similarity of
+	// their summaries and then search only their chunks.
+	Mode      string
+	Documents int
+	// MinSimilarity, when set, drops retrieved chunks less similar to the
+	// question, with the similarity of their KB's metric.
+	MinSimilarity *float64
+}
+
+func (o RetrievalOptions) withDefaults() RetrievalOptions {
+	if o.Candidates <= 0 {
+		o.Candidates = defaultRetrievalCandidates
+	}
+	if o.TopK <= 0 {
+		o.TopK = defaultRetrievalTopK
+	}
+	if o.Candidates < o.TopK {
+		o.Candidates = o.TopK
+	}
+	if o.Candidates > maxSearchDepth {
+		o.Candidates = maxSearchDepth
+	}
+	if o.MMRLambda <= 0 || o.MMRLambda > 1 {
+		o.MMRLambda = defaultMMRLambda
+	}
+	if o.Neighbours < 0 {
+		o.Neighbours = 0
+	}
+	if o.Neighbours > maxNeighbours {
+		o.Neighbours = maxNeighbours
+	}
+	if o.ContextTokens <= 0 {
+		o.ContextTokens = defaultContextTokens
+	}
+	if o.Mode == "" {
+		o.Mode = RetrievalModeChunks
+	}
+	if o.Documents <= 0 {
+		o.Documents = defaultDocumentCandidates
+	}
+	return o
+}
+
+// retrieve returns the chunks of the given knowledge bases that best answer
+// question. It fetches a candidate set from each KB by vector similarity
+// (optionally restricted to the files with the most similar summaries),
+// reorders the merged candidates with the configured Reranker and keeps the
+// top results, diversified by maximal marginal relevance unless
+// opts.MMRLambda is 1. Each chunk is labelled with its KB. The question is
+// embedded by emb with each KB's embedding model; model is the chat model
+// answering it, used by the Reranker.
+func (h *KBHandler) retrieve(ctx context.Context, kbs []kbSettings, question string, emb *queryEmbedder, opts RetrievalOptions, model string) ([]questionChunk, error) {
+	opts = opts.withDefaults()
+	diversify := opts.MMRLambda < 1
+	limit := opts.Candidates
+	if h.Reranker == nil && !diversify {
+		limit = opts.TopK
+	}
+	perKB := make([][]questionChunk, len(kbs))
+	for i, kb := range kbs {
+		vec, err := emb.embed(withUsage(ctx, kb.ID, opQuery), kb.EmbeddingModel)
+		if err != nil {
+			return nil, &embeddingError{err}
+		}
+		search := searchOptions{
+			Limit:          limit,
+			MinSimilarity:  opts.MinSimilarity,
+			WithEmbeddings: diversify,
+		}
+		if opts.Mode == RetrievalModeTwoStage {
+			docs, err := h.topDocuments(ctx, kb, vec, opts.Documents)
+			if err != nil {
+				return nil, err
+			}
+			// Files uploaded before summaries existed have none; fall back to
+			// searching the whole KB rather than finding nothing.
+			if len(docs) > 0 {
+				search.Files = docs
+			}
+		}
+		found, err := h.searchChunks(ctx, kb, vec, search)
+		if err != nil {
+			return nil, err
+		}
+		for j := range found {
+			found[j].KBID = kb.ID
+			found[j].KBName = kb.Name
+		}
+		perKB[i] = found
+	}
+	chunks := mergeByRank(perKB)
+	var err error
+	if h.Reranker != nil {
+		if chunks, err = h.Reranker.Rerank(withAnswerUsage(ctx, kbs, opRerank), model, question, chunks); err != nil {
+			return nil, err
+		}
+	}
+	if diversify {
+		// The similarities of KBs with different metrics are not comparable,
+		// so merged candidates are judged by their position like reranked ones.
+		ranked := h.Reranker != nil || len(kbs) > 1
+		return selectMMR(chunks, ranked, opts.MMRLambda, opts.TopK), nil
+	}
+	if len(chunks) > opts.TopK {
+		chunks = chunks[:opts.TopK]
+	}
+	return chunks, nil
+}
+
+// mergeByRank merges the chunks found in several knowledge bases, each ordered
+// by its KB's metric, by their rank within their KB: the similarities of
+// different metrics are on different scales and cannot be compared. Chunks of
+// equal rank keep the order of their KBs.
+func mergeByRank(perKB [][]questionChunk) []questionChunk {
+	var merged []questionChunk
+	for rank := 0; ; rank++ {
+		found := false
+		for _, chunks := range perKB {
+			if rank < len(chunks) {
+				merged = append(merged, chunks[rank])
+				found = true
+			}
+		}
+		if !found {
+			return merged
+		}
+	}
+}
+
+// selectMMR picks k chunks by maximal marginal relevance. Ranked chunks, such
+// as reranked ones, are judged by their position in the given order, since
+// reranker scores often tie and merged similarities are not comparable;
+// otherwise the vector similarity is the relevance.
+func selectMMR(chunks []questionChunk, ranked bool, lambda float64, k int) []questionChunk {
+	relevance := make([]float64, len(chunks))
+	vectors := make([][]float32, len(chunks))
+	for i, c := range chunks {
+		relevance[i] = c.Similarity
+		if ranked {
+			relevance[i] = float64(len(chunks) - i)
+		}
+		vectors[i] = c.embedding
+	}
+	picked := utils.MMR(relevance, vectors, lambda, k)
+	out := make([]questionChunk, len(picked))
+	for i, idx := range picked {
+		out[i] = chunks[idx]
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVectorLiteral(t *testing.T) {
+	vec, err := parseVectorLiteral("[1,0.5,-2]")
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{1, 0.5, -2}, vec)
+
+	_, err = parseVectorLiteral("1,2")
+	assert.Error(t, err)
+}
+
+func TestSelectMMR(t *testing.T) {
+	chunks := []questionChunk{
+		{FileName: "a.md", Index: 0, Similarity: 0.95, embedding: []float32{1, 0}},
+		{FileName: "a.md", Index: 1, Similarity: 0.94, embedding: []float32{1, 0.01}},
+		{FileName: "b.md", Index: 0, Similarity: 0.80, embedding: []float32{0, 1}},
+	}
+	out := selectMMR(chunks, false, 0.5, 2)
+	assert.Equal(t, []string{"a.md", "b.md"}, []string{out[0].FileName, out[1].FileName})
+
+	out = selectMMR(chunks, false, 1, 2)
+	assert.Equal(t, []string{"a.md", "a.md"}, []string{out[0].FileName, out[1].FileName})
+}
+
+func TestMergeByRank(t *testing.T) {
+	// An inner product KB's raw scores would outrank the cosine KB's.
+	cosine := []questionChunk{{KBID: 1, Index: 0, Similarity: 0.9}, {KBID: 1, Index: 1, Similarity: 0.8}, {KBID: 1, Index: 2, Similarity: 0.7}}
+	innerProduct := []questionChunk{{KBID: 2, Index: 0, Similarity: 12}, {KBID: 2, Index: 1, Similarity: 11}}
+
+	merged := mergeByRank([][]questionChunk{cosine, innerProduct})
+	var order []int64
+	for _, c := range merged {
+		order = append(order, c.KBID*10+int64(c.Index))
+	}
+	assert.Equal(t, []int64{10, 20, 11, 21, 12}, order)
+}
+
+func TestPassageWindows(t *testing.T) {
+	hits := []questionChunk{
+		{FileName: "a.md", FileSlug: "a-md", Index: 7},
+		{FileName: "b.md", FileSlug: "b-md", Index: 0},
+		{FileName: "a.md", FileSlug: "a-md", Index: 3},
+		{FileName: "a.md", FileSlug: "a-md", Index: 5},
+		{FileName: "a.md", FileSlug: "a-md", Index: 12},
+	}
+	passages := passageWindows(hits, 1)
+	if assert.Len(t, passages, 3) {
+		// a.md 3, 5 and 7 touch once widened and merge into one window
+		assert.Equal(t, "a.md", passages[0].FileName)
+		assert.Equal(t, 2, passages[0].First)
+		assert.Equal(t, 8, passages[0].Last)
+		assert.Len(t, passages[0].Hits, 3)
+
+		assert.Equal(t, "b.md", passages[1].FileName)
+		assert.Equal(t, 0, passages[1].First)
+		assert.Equal(t, 1, passages[1].Last)
+
+		assert.Equal(t, 11, passages[2].First)
+		assert.Equal(t, 13, passages[2].Last)
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	// maxRoutedKBs is the most knowledge bases a routed question consults.
+	maxRoutedKBs = 3
+	// routeMargin admits further KBs whose score is this close to the best.
+	routeMargin = 0.05
+)
+
+// kbRoute reports why a knowledge base was consulted for a routed question.
+type kbRoute struct {
+	KBID   int64   `json:"kb_id"`
+	KBName string  `json:"kb_name"`
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason"`
+}
+
+// routeQuestion scores every knowledge base of the user against the question,
+// embedded by emb with each KB's embedding model, and returns the best ones. A
+// KB scores the higher of the cosine similarity between the question and its
+// description, and the similarity of its closest chunk found by a probe
+// search. The best KB is always chosen;
+// others follow while within routeMargin of it, up to maxRoutedKBs.
+func (h *KBHandler) routeQuestion(ctx context.Context, userID int64, emb *queryEmbedder) ([]kbSettings, []kbRoute, error) {
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT `+kbSettingsColumns+`, description_embedding::text
+		FROM knowledge_bases WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	type candidate struct {
+		kb    kbSettings
+		route kbRoute
+	}
+	var candidates []candidate
+	var descEmbeddings [][]float32
+	for rows.Next() {
+		var kb kbSettings
+		var descEmb sql.NullString
+		if err := scanKBSettings(rows, &kb, &descEmb); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		var emb []float32
+		if descEmb.Valid {
+			if emb, err = parseVectorLiteral(descEmb.String); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+		}
+		candidates = append(candidates, candidate{kb: kb})
+		descEmbeddings = append(descEmbeddings, emb)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range candidates {
+		c := &candidates[i]
+		vec, err := emb.embed(withUsage(ctx, c.kb.ID, opQuery), c.kb.EmbeddingModel)
+		if err != nil {
+			return nil, nil, &embeddingError{err}
+		}
+		c.route = kbRoute{KBID: c.kb.ID, KBName: c.kb.Name, Reason: "no description and no content"}
+		if descEmbeddings[i] != nil {
+			c.route.Score = utils.CosineSimilarity(vec, descEmbeddings[i])
+			c.route.Reason = fmt.Sprintf("description similarity %.2f", c.route.Score)
+		}
+		probe, err := h.searchChunks(ctx, c.kb, vec, searchOptions{Limit: 1, WithEmbeddings: true})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(probe) > 0 {
+			sim := utils.CosineSimilarity(vec, probe[0].embedding)
+			if descEmbeddings[i] == nil || sim > c.route.Score {
+				c.route.Score = sim
+				c.route.Reason = fmt.Sprintf("closest passage similarity %.2f (%s)", sim, probe[0].FileName)
+			}
+		}
+	}
+
+	routes := make([]kbRoute, len(candidates))
+	byID := map[int64]kbSettings{}
+	for i, c := range candidates {
+		routes[i] = c.route
+		byID[c.kb.ID] = c.kb
+	}
+	routes = pickRoutes(routes)
+	kbs := make([]kbSettings, len(routes))
+	for i, route := range routes {
+		kbs[i] = byID[route.KBID]
+	}
+	return kbs, routes, nil
+}
+
+// pickRoutes orders scored KBs best first and keeps the best one plus those
+// within routeMargin of it, up to maxRoutedKBs.
+func pickRoutes(routes []kbRoute) []kbRoute {
+	sort.SliceStable(routes, func(a, b int) bool { return routes[a].Score > routes[b].Score })
+	var picked []kbRoute
+	for _, route := range routes {
+		if len(picked) == maxRoutedKBs || (len(picked) > 0 && route.Score < picked[0].Score-routeMargin) {
+			break
+		}
+		picked = append(picked, route)
+	}
+	return picked
+}
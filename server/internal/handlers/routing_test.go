@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickRoutes(t *testing.T) {
+	routes := pickRoutes([]kbRoute{
+		{KBID: 1, Score: 0.40},
+		{KBID: 2, Score: 0.81},
+		{KBID: 3, Score: 0.78},
+		{KBID: 4, Score: 0.70},
+	})
+	assert.Equal(t, []int64{2, 3}, []int64{routes[0].KBID, routes[1].KBID})
+	assert.Len(t, routes, 2)
+
+	routes = pickRoutes([]kbRoute{{KBID: 1}, {KBID: 2}, {KBID: 3}, {KBID: 4}})
+	assert.Len(t, routes, maxRoutedKBs)
+
+	assert.Empty(t, pickRoutes(nil))
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+	snippetLength      = 200
+
+	// defaultEfSearch is pgvector's default hnsw.ef_search, the number of
+	// rows an HNSW index scan returns at most.
+	defaultEfSearch = 40
+	// maxSearchDepth is the largest hnsw.ef_search pgvector accepts, and so
+	// the deepest a search can page.
+	maxSearchDepth = 1000
+)
+
+// searchOptions controls paging and filtering of a chunk search.
+type searchOptions struct {
+	Limit         int
+	Offset        int
+	MinSimilarity *float64
+	// WithEmbeddings also loads each chunk's embedding vector.
+	WithEmbeddings bool
+	// Files, when non-nil, restricts the search to chunks of these file slugs.
+	Files []string
+}
+
+// searchRequest represents the JSON payload of POST /api/kbs/{kbID}/search.
+type searchRequest struct {
+	Query         string   `json:"q"`
+	Limit         int      `json:"limit"`
+	Offset        int      `json:"offset"`
+	MinSimilarity *float64 `json:"min_similarity"`
+}
+
+// searchResult is a single ranked chunk returned by the search endpoint.
+type searchResult struct {
+	FileName   string  `json:"file_name"`
+	FileSlug   string  `json:"file_slug"`
+	ChunkIndex int     `json:"chunk_index"`
+	Distance   float64 `json:"distance"`
+	Score      float64 `json:"score"`
+	Snippet    string  `json:"snippet"`
+}
+
+type searchResponse struct {
+	Query   string         `json:"q"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+	Results []searchResult `json:"results"`
+}
+
+// embedText returns the embedding vector of a single piece of text.
+func (h *KBHandler) embedText(ctx context.Context, model, text string) ([]float32, error) {
+	embResp, err := h.OpenAI.CreateEmbeddings(ctx, go_openai.EmbeddingRequest{
+		Model: go_openai.EmbeddingModel(model),
+		Input: []string{text},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(embResp.Data) == 0 {
+		return nil, fmt.Errorf("no embedding returned")
+	}
+	return embResp.Data[0].Embedding, nil
+}
+
+// queryEmbedder embeds a question for the embedding models of the KBs it is
+// searched in, calling each model once.
+type queryEmbedder struct {
+	h       *KBHandler
+	text    string
+	vectors map[string][]float32
+}
+
+func (h *KBHandler) newQueryEmbedder(text string) *queryEmbedder {
+	return &queryEmbedder{h: h, text: text, vectors: map[string][]float32{}}
+}
+
+// embed returns the embedding of the text under model.
+func (e *queryEmbedder) embed(ctx context.Context, model string) ([]float32, error) {
+	if vec, ok := e.vectors[model]; ok {
+		return vec, nil
+	}
+	vec, err := e.h.embedText(ctx, model, e.text)
+	if err != nil {
+		return nil, err
+	}
+	e.vectors[model] = vec
+	return vec, nil
+}
+
+// searchChunks returns the chunks of a knowledge base nearest to vec, ordered
+// by increasing distance under the KB's metric. The embeddings are cast to the
+// KB's dimensions so the search can use the KB's vector index, whose scan is
+// widened to cover opts.Limit rows past opts.Offset, and continued past that
+// when opts.Files filters the rows it returns.
+func (h *KBHandler) searchChunks(ctx context.Context, kb kbSettings, vec []float32, opts searchOptions) ([]questionChunk, error) {
+	metric := kb.DistanceMetric
+	embeddingCol := `''`
+	if opts.WithEmbeddings {
+		embeddingCol = `embedding::text`
+	}
+	args := []any{kb.ID, vectorLiteral(vec)}
+	filter := `kb_id = $1`
+	if opts.Files != nil {
+		args = append(args, pq.Array(opts.Files))
+		filter += fmt.Sprintf(` AND lookup_name = ANY($%d)`, len(args))
+	}
+	query := `SELECT id, file_name, lookup_name, chunk_index, content, section_id, distance, emb FROM (
+		SELECT id, file_name, lookup_name, chunk_index, content, COALESCE(section_id, 0) AS section_id,
+			` + indexedEmbedding(kb.EmbeddingDimensions) + ` ` + metric.operator() + ` $2::vector AS distance, ` + embeddingCol + ` AS emb
+		FROM chunks WHERE ` + filter + `) c`
+	if opts.MinSimilarity != nil {
+		args = append(args, *opts.MinSimilarity)
+		query += fmt.Sprintf(` WHERE distance <> 'NaN' AND %s >= $%d`, metric.similaritySQL("distance"), len(args))
+	}
+	args = append(args, opts.Limit, opts.Offset)
+	query += fmt.Sprintf(` ORDER BY distance LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	ef := min(max(opts.Limit+opts.Offset, defaultEfSearch), maxSearchDepth)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`SET LOCAL hnsw.ef_search = %d`, ef)); err != nil {
+		return nil, err
+	}
+	// The file filter is applied to the rows the index scan returns, so a scan
+	// stopping after ef_search rows finds too few chunks of files far from the
+	// question. Iterative scans keep going until enough rows pass the filter.
+	if opts.Files != nil {
+		if _, err := tx.ExecContext(ctx, `SET LOCAL hnsw.iterative_scan = strict_order`); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []questionChunk
+	for rows.Next() {
+		var c questionChunk
+		var emb string
+		if err := rows.Scan(&c.ID, &c.FileName, &c.FileSlug, &c.Index, &c.Content, &c.sectionID, &c.Distance, &emb); err != nil {
+			return nil, err
+		}
+		if opts.WithEmbeddings {
+			if c.embedding, err = parseVectorLiteral(emb); err != nil {
+				return nil, err
+			}
+		}
+		c.Distance = sanitizeDistance(c.Distance)
+		c.Similarity = metric.similarity(c.Distance)
+		chunks = append(chunks, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return chunks, tx.Commit()
+}
+
+// parseSearchRequest reads the search parameters from the query string (GET)
+// or the JSON body (POST).
+func parseSearchRequest(r *http.Request) (searchRequest, error) {
+	var req searchRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, err
+		}
+		return req, nil
+	}
+	q := r.URL.Query()
+	req.Query = q.Get("q")
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if req.Limit, err = strconv.Atoi(v); err != nil {
+			return req, fmt.Errorf("invalid limit")
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if req.Offset, err = strconv.Atoi(v); err != nil {
+			return req, fmt.Errorf("invalid offset")
+		}
+	}
+	if v := q.Get("min_similarity"); v != "" {
+		minSimilarity, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return req, fmt.Errorf("invalid min_similarity")
+		}
+		req.MinSimilarity = &minSimilarity
+	}
+	return req, nil
+}
+
+// Search handles GET and POST /api/kbs/{kbID}/search
+func (h *KBHandler) Search(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	kbIDStr := chi.URLParam(r, "kbID")
+	kbID, err := strconv.ParseInt(kbIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid kb ID", http.StatusBadRequest)
+		return
+	}
+
+	// Check KB ownership
+	if err := h.checkKBOwnership(kbID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	req, err := parseSearchRequest(r)
+	if err != nil || req.Query == "" || req.Limit < 0 || req.Offset < 0 {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultSearchLimit
+	}
+	if req.Limit > maxSearchLimit {
+		req.Limit = maxSearchLimit
+	}
+	if req.Offset+req.Limit > maxSearchDepth {
+		http.Error(w, fmt.Sprintf("offset + limit must be at most %d", maxSearchDepth), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	kb, err := h.loadKBSettings(ctx, kbID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	vec, err := h.embedText(withUsage(ctx, kb.ID, opQuery), kb.EmbeddingModel, req.Query)
+	if err != nil {
+		http.Error(w, "embedding failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chunks, err := h.searchChunks(ctx, kb, vec, searchOptions{
+		Limit:         req.Limit,
+		Offset:        req.Offset,
+		MinSimilarity: req.MinSimilarity,
+	})
+	if err != nil {
+		http.Error(w, "search failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]searchResult, 0, len(chunks))
+	for _, c := range chunks {
+		results = append(results, searchResult{
+			FileName:   c.FileName,
+			FileSlug:   c.FileSlug,
+			ChunkIndex: c.Index,
+			Distance:   c.Distance,
+			Score:      c.Similarity,
+			Snippet:    utils.Snippet(c.Content, snippetLength),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searchResponse{Query: req.Query, Limit: req.Limit, Offset: req.Offset, Results: results})
+}
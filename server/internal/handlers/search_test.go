@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectChunkSearch expects a chunk search whose index scan is widened to ef
+// rows.
+func expectChunkSearch(mock sqlmock.Sqlmock, ef string, rows *sqlmock.Rows) *sqlmock.ExpectedQuery {
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL hnsw.ef_search = " + ef).WillReturnResult(sqlmock.NewResult(0, 0))
+	query := mock.ExpectQuery("FROM chunks").WillReturnRows(rows)
+	mock.ExpectCommit()
+	return query
+}
+
+func TestSearchChunksWidensIndexScan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "file_name", "lookup_name", "chunk_index", "content", "section_id", "distance", "emb"}
+	h := NewKBHandler(db, nil)
+	kb := kbSettings{ID: 7, DistanceMetric: DistanceCosine, EmbeddingDimensions: 2}
+
+	// The default 50 retrieval candidates exceed pgvector's default of 40.
+	expectChunkSearch(mock, "50", sqlmock.NewRows(columns))
+	_, err = h.searchChunks(context.Background(), kb, []float32{1, 0}, searchOptions{Limit: RetrievalOptions{}.withDefaults().Candidates})
+	assert.NoError(t, err)
+
+	expectChunkSearch(mock, "60", sqlmock.NewRows(columns))
+	_, err = h.searchChunks(context.Background(), kb, []float32{1, 0}, searchOptions{Limit: 10, Offset: 50})
+	assert.NoError(t, err)
+
+	// Small searches keep the default.
+	expectChunkSearch(mock, "40", sqlmock.NewRows(columns))
+	_, err = h.searchChunks(context.Background(), kb, []float32{1, 0}, searchOptions{Limit: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSearchChunksScansOnPastFilteredRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "file_name", "lookup_name", "chunk_index", "content", "section_id", "distance", "emb"}
+	h := NewKBHandler(db, nil)
+	kb := kbSettings{ID: 7, DistanceMetric: DistanceCosine, EmbeddingDimensions: 2}
+
+	// Chunks of the selected file lie beyond the first ef_search rows of the
+	// index, so the scan must continue until they are found.
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL hnsw.ef_search = 40").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL hnsw.iterative_scan = strict_order").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("lookup_name = ANY\\(\\$3\\)").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(9, "far.md", "far-md", 0, "far", 0, 0.9, ""))
+	mock.ExpectCommit()
+	out, err := h.searchChunks(context.Background(), kb, []float32{1, 0}, searchOptions{Limit: 5, Files: []string{"far-md"}})
+	assert.NoError(t, err)
+	if assert.Len(t, out, 1) {
+		assert.Equal(t, "far-md", out[0].FileSlug)
+	}
+
+	// Unfiltered searches stop at ef_search rows.
+	expectChunkSearch(mock, "40", sqlmock.NewRows(columns))
+	_, err = h.searchChunks(context.Background(), kb, []float32{1, 0}, searchOptions{Limit: 5})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+)
+
+// ChatStream is a chat completion streamed delta by delta; see ai.ChatStream.
+type ChatStream = ai.ChatStream
+
+// wantsEventStream reports whether the client asked for a Server-Sent Events
+// response.
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamChunksEvent is the first event of a streamed answer, carrying the
+// context the answer is built from.
+type streamChunksEvent struct {
+	Chunks  []questionChunk `json:"chunks"`
+	Routing []kbRoute       `json:"routing,omitempty"`
+}
+
+// streamTokenEvent carries one piece of the answer as it is generated.
+type streamTokenEvent struct {
+	Content string `json:"content"`
+}
+
+// streamDoneEvent closes a streamed answer.
+type streamDoneEvent struct {
+	Answer         string           `json:"answer"`
+	Usage          *go_openai.Usage `json:"usage,omitempty"`
+	Citations      []citation       `json:"citations"`
+	ConversationID int64            `json:"conversation_id,omitempty"`
+	Cached         bool             `json:"cached,omitempty"`
+	// NoRelevantContext is set when the answer had no context to draw on.
+	NoRelevantContext bool             `json:"no_relevant_context,omitempty"`
+	Grounding         *groundingReport `json:"grounding,omitempty"`
+	AnswerID          int64            `json:"answer_id,omitempty"`
+}
+
+// streamErrorEvent reports a failure after the stream has started.
+type streamErrorEvent struct {
+	Error string `json:"error"`
+}
+
+// writeEvent writes one Server-Sent Event with a JSON payload and flushes it.
+func writeEvent(w http.ResponseWriter, name string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// streamAnswer answers with Server-Sent Events: a "chunks" event with the
+// retrieved context, a "token" event per generated delta and a final "done"
+// event with the full answer, token usage and the citations found in it.
+// The exchange is stored before the "done" event when req continues a
+// conversation. Failures once the stream has started are reported as an
+// "error" event. The upstream request uses the request context, so it is
+// cancelled when the client disconnects. A completed answer is cached under
+// cacheKey unless it is the zero key, and recorded for feedback on the KBs
+// kbIDs.
+func (h *KBHandler) streamAnswer(w http.ResponseWriter, r *http.Request, kbIDs []int64, chatReq go_openai.ChatCompletionRequest, req questionRequest, resp questionResponse, passages []contextPassage, cacheKey answerCacheKey) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, "chunks", streamChunksEvent{Chunks: resp.Chunks, Routing: resp.Routing}); err != nil {
+		return
+	}
+
+	chatReq.Stream = true
+	chatReq.StreamOptions = &go_openai.StreamOptions{IncludeUsage: true}
+	stream, err := h.OpenAI.CreateChatCompletionStream(ctx, chatReq)
+	if err != nil {
+		writeEvent(w, "error", streamErrorEvent{Error: "openai failed: " + err.Error()})
+		return
+	}
+	defer stream.Close()
+
+	var answer strings.Builder
+	var usage *go_openai.Usage
+	for {
+		delta, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				writeEvent(w, "error", streamErrorEvent{Error: "openai failed: " + err.Error()})
+			}
+			return
+		}
+		if delta.Usage != nil {
+			usage = delta.Usage
+		}
+		if len(delta.Choices) == 0 || delta.Choices[0].Delta.Content == "" {
+			continue
+		}
+		content := delta.Choices[0].Delta.Content
+		answer.WriteString(content)
+		if err := writeEvent(w, "token", streamTokenEvent{Content: content}); err != nil {
+			// The client went away; returning closes the upstream stream.
+			return
+		}
+	}
+	citations := parseCitations(answer.String(), passages)
+	grounding := h.checkGrounding(ctx, chatReq.Model, answer.String(), passages)
+	if cacheKey.hash != "" {
+		cached := cachedAnswer{Answer: answer.String(), Chunks: resp.Chunks, Citations: citations, NoRelevantContext: resp.NoRelevantContext, Grounding: grounding}
+		if err := h.storeAnswer(ctx, cacheKey, cached); err != nil {
+			log.Printf("could not cache answer: %v", err)
+		}
+	}
+	if req.ConversationID != 0 {
+		if err := h.saveExchange(ctx, req.ConversationID, req.Question, answer.String(), citations); err != nil {
+			writeEvent(w, "error", streamErrorEvent{Error: "could not save conversation: " + err.Error()})
+			return
+		}
+	}
+	resp.Answer, resp.Citations = answer.String(), citations
+	writeEvent(w, "done", streamDoneEvent{
+		Answer:            answer.String(),
+		Usage:             usage,
+		Citations:         citations,
+		ConversationID:    req.ConversationID,
+		NoRelevantContext: resp.NoRelevantContext,
+		Grounding:         grounding,
+		AnswerID:          h.recordAnswer(ctx, kbIDs, req.Question, resp),
+	})
+}
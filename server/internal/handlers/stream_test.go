@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticStream replays fixed deltas, then the usage, then io.EOF. When err is
+// set it is returned instead of io.EOF.
+type staticStream struct {
+	deltas []string
+	usage  *go_openai.Usage
+	err    error
+	closed bool
+}
+
+func (s *staticStream) Recv() (go_openai.ChatCompletionStreamResponse, error) {
+	if len(s.deltas) > 0 {
+		d := s.deltas[0]
+		s.deltas = s.deltas[1:]
+		return go_openai.ChatCompletionStreamResponse{Choices: []go_openai.ChatCompletionStreamChoice{{Delta: go_openai.ChatCompletionStreamChoiceDelta{Content: d}}}}, nil
+	}
+	if s.usage != nil {
+		u := s.usage
+		s.usage = nil
+		return go_openai.ChatCompletionStreamResponse{Usage: u}, nil
+	}
+	if s.err != nil {
+		return go_openai.ChatCompletionStreamResponse{}, s.err
+	}
+	return go_openai.ChatCompletionStreamResponse{}, io.EOF
+}
+
+func (s *staticStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// streamAI hands out a prepared stream and records the request.
+type streamAI struct {
+	chatStubAI
+	stream  *staticStream
+	lastReq go_openai.ChatCompletionRequest
+}
+
+func (a *streamAI) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ChatStream, error) {
+	a.lastReq = req
+	return a.stream, nil
+}
+
+func TestStreamAnswer(t *testing.T) {
+	stream := &staticStream{deltas: []string{"Hel", "lo [1]"}, usage: &go_openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}}
+	ai := &streamAI{stream: stream}
+	h := &KBHandler{OpenAI: ai}
+	resp := questionResponse{Chunks: []questionChunk{{FileName: "a.md", Content: "hello"}}}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/kbs/1/ask", nil)
+	w := httptest.NewRecorder()
+	passages := []contextPassage{{FileName: "a.md", FileSlug: "a-md", First: 2, Last: 2, Text: "hello"}}
+	h.streamAnswer(w, r, nil, go_openai.ChatCompletionRequest{Model: go_openai.GPT3Dot5Turbo}, questionRequest{}, resp, passages, answerCacheKey{})
+
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.True(t, ai.lastReq.Stream)
+	assert.True(t, ai.lastReq.StreamOptions.IncludeUsage)
+	assert.True(t, stream.closed)
+	body := w.Body.String()
+	events := strings.Split(strings.TrimSpace(body), "\n\n")
+	assert.Len(t, events, 4)
+	assert.True(t, strings.HasPrefix(events[0], "event: chunks\ndata: {\"chunks\":[{"))
+	assert.Equal(t, "event: token\ndata: {\"content\":\"Hel\"}", events[1])
+	assert.Equal(t, "event: token\ndata: {\"content\":\"lo [1]\"}", events[2])
+	assert.True(t, strings.HasPrefix(events[3], "event: done\ndata: {\"answer\":\"Hello [1]\",\"usage\":{\"prompt_tokens\":10"))
+	assert.Contains(t, events[3], `"citations":[{"marker":1,"kb_id":0,"file_name":"a.md","file_slug":"a-md","chunk_index":2,"last_chunk_index":2}]`)
+}
+
+func TestStreamAnswerUpstreamError(t *testing.T) {
+	stream := &staticStream{deltas: []string{"Hel"}, err: errors.New("boom")}
+	h := &KBHandler{OpenAI: &streamAI{stream: stream}}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/kbs/1/ask", nil)
+	w := httptest.NewRecorder()
+	h.streamAnswer(w, r, nil, go_openai.ChatCompletionRequest{}, questionRequest{}, questionResponse{}, nil, answerCacheKey{})
+
+	body := w.Body.String()
+	assert.Contains(t, body, "event: error\ndata: {\"error\":\"openai failed: boom\"}")
+	assert.NotContains(t, body, "event: done")
+	assert.True(t, stream.closed)
+}
+
+func TestStreamAnswerClientDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream := &staticStream{err: context.Canceled}
+	h := &KBHandler{OpenAI: &streamAI{stream: stream}}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/kbs/1/ask", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	h.streamAnswer(w, r, nil, go_openai.ChatCompletionRequest{}, questionRequest{}, questionResponse{}, nil, answerCacheKey{})
+
+	body := w.Body.String()
+	assert.NotContains(t, body, "event: error")
+	assert.NotContains(t, body, "event: done")
+	assert.True(t, stream.closed)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	// summaryInputTokens bounds how much of a file is sent to the model when
+	// summarising it.
+	summaryInputTokens = 3000
+	// defaultDocumentCandidates is how many files two-stage retrieval selects
+	// by summary similarity before searching their chunks.
+	defaultDocumentCandidates = 5
+)
+
+// Retrieval modes selectable per request or via RetrievalOptions.Mode.
+const (
+	RetrievalModeChunks   = "chunks"
+	RetrievalModeTwoStage = "two_stage"
+)
+
+// summarizeFile generates a short summary of an uploaded file with the chat
+// model, embeds it and stores it in file_summaries, replacing any previous
+// summary of the same file.
+func (h *KBHandler) summarizeFile(ctx context.Context, kb kbSettings, fileName, lookup, text string) error {
+	ctx = withUsage(ctx, kb.ID, opSummarize)
+	resp, err := h.OpenAI.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Model: h.Models.withDefaults().Chat,
+		Messages: []go_openai.ChatCompletionMessage{
+			{Role: "system", Content: "Summarise the document in at most five sentences. Mention its main topics and the questions it can answer."},
+			{Role: "user", Content: fmt.Sprintf("Document: %s\n\n%s", fileName, utils.TruncateTokens(text, summaryInputTokens))},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Choices) == 0 {
+		return fmt.Errorf("no completion returned")
+	}
+	summary := strings.TrimSpace(resp.Choices[0].Message.Content)
+	vec, err := h.embedText(ctx, kb.EmbeddingModel, summary)
+	if err != nil {
+		return err
+	}
+	_, err = h.DB.ExecContext(ctx,
+		`INSERT INTO file_summaries(kb_id, lookup_name, file_name, summary, embedding) VALUES($1,$2,$3,$4,$5::vector)
+		ON CONFLICT (kb_id, lookup_name) DO UPDATE SET file_name=EXCLUDED.file_name, summary=EXCLUDED.summary, embedding=EXCLUDED.embedding, created_at=now()`,
+		kb.ID, lookup, fileName, summary, vectorLiteral(vec),
+	)
+	return err
+}
+
+// topDocuments returns the slugs of the files whose summaries are nearest to
+// vec.
+func (h *KBHandler) topDocuments(ctx context.Context, kb kbSettings, vec []float32, limit int) ([]string, error) {
+	rows, err := h.DB.QueryContext(ctx,
+		`SELECT lookup_name FROM file_summaries WHERE kb_id = $1 ORDER BY embedding `+kb.DistanceMetric.operator()+` $2::vector LIMIT $3`,
+		kb.ID, vectorLiteral(vec), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var slugs []string
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, rows.Err()
+}
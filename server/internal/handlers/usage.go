@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+	"github.com/zkiss/kb-codex/internal/config"
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+// Operations AI usage is recorded under.
+const (
+	opIndex     = ai.OpIndex
+	opSummarize = ai.OpSummarize
+	opDescribe  = ai.OpDescribe
+	opProbe     = ai.OpProbe
+	opQuery     = ai.OpQuery
+	opRewrite   = ai.OpRewrite
+	opRerank    = ai.OpRerank
+	opAnswer    = ai.OpAnswer
+	opVerify    = ai.OpVerify
+)
+
+// defaultUsageDays is the period GET /api/usage reports unless asked for
+// another.
+const defaultUsageDays = 30
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice = config.ModelPrice
+
+// DefaultPrices are the list prices of common OpenAI models, used for models
+// the configured price table does not cover.
+var DefaultPrices = map[string]ModelPrice{
+	go_openai.GPT4oMini:               {Input: 0.15, Output: 0.60},
+	go_openai.GPT4o:                   {Input: 2.50, Output: 10.00},
+	go_openai.GPT4Dot1:                {Input: 2.00, Output: 8.00},
+	go_openai.GPT4Dot1Mini:            {Input: 0.40, Output: 1.60},
+	go_openai.GPT3Dot5Turbo:           {Input: 0.50, Output: 1.50},
+	string(go_openai.AdaEmbeddingV2):  {Input: 0.10},
+	string(go_openai.SmallEmbedding3): {Input: 0.02},
+	string(go_openai.LargeEmbedding3): {Input: 0.13},
+}
+
+// usageScope attributes AI calls made with a context to knowledge bases. The
+// user is taken from the authenticated request and the operation from
+// ai.OperationOf.
+type usageScope struct {
+	// KBIDs are the KBs the calls count against. Calls are attributed to a
+	// KB only when there is a single one.
+	KBIDs []int64
+}
+
+type usageScopeKey struct{}
+
+// withUsage returns ctx attributing AI calls to kbID and operation. Zero
+// values keep the attribution of ctx.
+func withUsage(ctx context.Context, kbID int64, operation string) context.Context {
+	if kbID != 0 {
+		ctx = context.WithValue(ctx, usageScopeKey{}, usageScope{KBIDs: []int64{kbID}})
+	}
+	if operation != "" {
+		ctx = ai.WithOperation(ctx, operation)
+	}
+	return ctx
+}
+
+// withAnswerUsage returns ctx attributing AI calls to operation and counting
+// them against every KB an answer is drawn from.
+func withAnswerUsage(ctx context.Context, kbs []kbSettings, operation string) context.Context {
+	ctx = withUsage(ctx, 0, operation)
+	if len(kbs) == 0 {
+		return ctx
+	}
+	scope := usageScope{KBIDs: make([]int64, len(kbs))}
+	for i, kb := range kbs {
+		scope.KBIDs[i] = kb.ID
+	}
+	return context.WithValue(ctx, usageScopeKey{}, scope)
+}
+
+// usageRecorder is an AIClient recording the tokens and estimated cost of
+// every successful call in the ai_usage table.
+type usageRecorder struct {
+	AIClient
+	db     *sql.DB
+	prices map[string]ModelPrice
+}
+
+// RecordUsage wraps ai so that its calls are recorded in db, priced by
+// prices and, for models missing there, DefaultPrices.
+func RecordUsage(db *sql.DB, ai AIClient, prices map[string]ModelPrice) AIClient {
+	return &usageRecorder{AIClient: ai, db: db, prices: prices}
+}
+
+// CreateEmbeddings implements AIClient.
+func (u *usageRecorder) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	resp, err := u.AIClient.CreateEmbeddings(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	conv := req.Convert()
+	prompt := resp.Usage.PromptTokens
+	if prompt == 0 {
+		// Some OpenAI-compatible servers report no usage.
+		if inputs, ok := conv.Input.([]string); ok {
+			for _, in := range inputs {
+				prompt += utils.CountTokens(in)
+			}
+		}
+	}
+	u.record(ctx, usedModel(string(conv.Model), string(resp.Model)), prompt, 0)
+	return resp, nil
+}
+
+// CreateChatCompletion implements AIClient.
+func (u *usageRecorder) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	resp, err := u.AIClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	usage := resp.Usage
+	if usage.TotalTokens == 0 {
+		var reply string
+		if len(resp.Choices) > 0 {
+			reply = resp.Choices[0].Message.Content
+		}
+		usage = estimateUsage(req, reply)
+	}
+	u.record(ctx, usedModel(req.Model, resp.Model), usage.PromptTokens, usage.CompletionTokens)
+	return resp, nil
+}
+
+// CreateChatCompletionStream implements AIClient. The usage is recorded when
+// the stream ends.
+func (u *usageRecorder) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := u.AIClient.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &usageStream{ChatStream: stream, recorder: u, ctx: ctx, req: req}, nil
+}
+
+// usageStream records the usage of a streamed completion once it is
+// finished or closed. Without a usage report from the provider, e.g. because
+// the client disconnected, the tokens are estimated.
+type usageStream struct {
+	ChatStream
+	recorder *usageRecorder
+	ctx      context.Context
+	req      go_openai.ChatCompletionRequest
+	reply    []byte
+	usage    *go_openai.Usage
+	model    string
+	recorded bool
+}
+
+func (s *usageStream) Recv() (go_openai.ChatCompletionStreamResponse, error) {
+	resp, err := s.ChatStream.Recv()
+	if err == nil {
+		if resp.Usage != nil {
+			s.usage = resp.Usage
+		}
+		if resp.Model != "" {
+			s.model = resp.Model
+		}
+		for _, c := range resp.Choices {
+			s.reply = append(s.reply, c.Delta.Content...)
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		s.record()
+	}
+	return resp, err
+}
+
+func (s *usageStream) Close() error {
+	s.record()
+	return s.ChatStream.Close()
+}
+
+func (s *usageStream) record() {
+	if s.recorded {
+		return
+	}
+	s.recorded = true
+	usage := estimateUsage(s.req, string(s.reply))
+	if s.usage != nil {
+		usage = *s.usage
+	}
+	s.recorder.record(s.ctx, usedModel(s.req.Model, s.model), usage.PromptTokens, usage.CompletionTokens)
+}
+
+// usedModel returns the model that served a call: the one the provider
+// reports, which differs from the requested one when the client failed over
+// to a fallback model, or else the requested one.
+func usedModel(requested, reported string) string {
+	if reported != "" {
+		return reported
+	}
+	return requested
+}
+
+// estimateUsage counts the tokens of a chat request and its reply.
+func estimateUsage(req go_openai.ChatCompletionRequest, reply string) go_openai.Usage {
+	var u go_openai.Usage
+	for _, m := range req.Messages {
+		u.PromptTokens += utils.CountTokens(m.Content) + messageOverheadTokens
+	}
+	u.CompletionTokens = utils.CountTokens(reply)
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// snapshotSuffix matches the date providers append to the model they report,
+// e.g. gpt-4o-mini-2024-07-18.
+var snapshotSuffix = regexp.MustCompile(`-\d{4}-\d{2}-\d{2}$`)
+
+// cost estimates the price of a call in USD. A dated snapshot of a model
+// without a price of its own costs as much as the model.
+func (u *usageRecorder) cost(model string, prompt, completion int) float64 {
+	price, ok := u.price(model)
+	if !ok {
+		price, _ = u.price(snapshotSuffix.ReplaceAllString(model, ""))
+	}
+	return (float64(prompt)*price.Input + float64(completion)*price.Output) / 1e6
+}
+
+// price looks model up in the configured prices, then in DefaultPrices.
+func (u *usageRecorder) price(model string) (ModelPrice, bool) {
+	if price, ok := u.prices[model]; ok {
+		return price, true
+	}
+	price, ok := DefaultPrices[model]
+	return price, ok
+}
+
+// record stores one call. Failing to record does not fail the call.
+func (u *usageRecorder) record(ctx context.Context, model string, prompt, completion int) {
+	insertUsage(ctx, u.db, model, prompt, completion, u.cost(model, prompt, completion))
+}
+
+// insertUsage stores a call in the ai_usage table, attributed by ctx.
+func insertUsage(ctx context.Context, db *sql.DB, model string, prompt, completion int, cost float64) {
+	scope, _ := ctx.Value(usageScopeKey{}).(usageScope)
+	userID, _ := utils.GetUserID(ctx)
+	operation := ai.OperationOf(ctx)
+	if operation == "" {
+		operation = "other"
+	}
+	var kbID sql.NullInt64
+	if len(scope.KBIDs) == 1 {
+		kbID = sql.NullInt64{Int64: scope.KBIDs[0], Valid: true}
+	}
+	kbIDs := scope.KBIDs
+	if kbIDs == nil {
+		kbIDs = []int64{}
+	}
+	_, err := db.ExecContext(context.WithoutCancel(ctx),
+		`INSERT INTO ai_usage(user_id, kb_id, kb_ids, operation, model, prompt_tokens, completion_tokens, cost_usd)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		sql.NullInt64{Int64: userID, Valid: userID != 0}, kbID, pq.Array(kbIDs),
+		operation, model, prompt, completion, cost,
+	)
+	if err != nil {
+		log.Printf("could not record AI usage: %v", err)
+	}
+}
+
+// usageTotals sums up AI calls.
+type usageTotals struct {
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// usageRow is the AI usage of a user on one day, for one KB. KBID is null
+// for usage not tied to a KB. Calls for several KBs, such as answers across
+// them, are counted in the row of each.
+type usageRow struct {
+	Date   string `json:"date"`
+	KBID   *int64 `json:"kb_id"`
+	KBName string `json:"kb_name"`
+	usageTotals
+}
+
+// usageResponse is the body of GET /api/usage.
+type usageResponse struct {
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Days  []usageRow  `json:"days"`
+	Total usageTotals `json:"total"`
+}
+
+// Usage handles GET /api/usage. It reports the caller's AI usage per day and
+// KB between the dates from and to (inclusive, YYYY-MM-DD, UTC), by default
+// over the last 30 days. The total counts every call once.
+func (h *KBHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.RequireUserID(r.Context())
+	if err != nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "invalid to: expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, 1-defaultUsageDays)
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "invalid from: expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	end := to.AddDate(0, 0, 1)
+	resp := usageResponse{From: from.Format(time.DateOnly), To: to.Format(time.DateOnly), Days: []usageRow{}}
+	err = h.DB.QueryRowContext(r.Context(),
+		`SELECT COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(cost_usd), 0)
+		FROM ai_usage WHERE user_id = $1 AND created_at >= $2 AND created_at < $3`,
+		userID, from, end,
+	).Scan(&resp.Total.Calls, &resp.Total.PromptTokens, &resp.Total.CompletionTokens, &resp.Total.CostUSD)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Calls without KBs are reported under a null KB.
+	rows, err := h.DB.QueryContext(r.Context(),
+		`SELECT to_char(u.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, k.kb_id, COALESCE(kb.name, ''),
+			COUNT(*), SUM(u.prompt_tokens), SUM(u.completion_tokens), SUM(u.cost_usd)
+		FROM ai_usage u
+			CROSS JOIN LATERAL unnest(COALESCE(NULLIF(u.kb_ids, '{}'), ARRAY[NULL::integer])) AS k(kb_id)
+			LEFT JOIN knowledge_bases kb ON kb.id = k.kb_id
+		WHERE u.user_id = $1 AND u.created_at >= $2 AND u.created_at < $3
+		GROUP BY day, k.kb_id, kb.name
+		ORDER BY day, k.kb_id NULLS FIRST`,
+		userID, from, end,
+	)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row usageRow
+		var kbID sql.NullInt64
+		if err := rows.Scan(&row.Date, &kbID, &row.KBName, &row.Calls, &row.PromptTokens, &row.CompletionTokens, &row.CostUSD); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if kbID.Valid {
+			row.KBID = &kbID.Int64
+		}
+		resp.Days = append(resp.Days, row)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
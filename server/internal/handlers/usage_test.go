@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+func TestRecordUsage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	stub := &streamAI{chatStubAI: chatStubAI{reply: "ok"}}
+	ai := RecordUsage(db, stub, map[string]ModelPrice{"m": {Input: 1, Output: 2}})
+	ctx := context.WithValue(context.Background(), utils.UserIDKey, int64(1))
+	ctx = withUsage(ctx, 7, opRerank)
+
+	// Without a usage report the tokens are estimated.
+	req := go_openai.ChatCompletionRequest{Model: "m", Messages: []go_openai.ChatCompletionMessage{{Role: "user", Content: "hello there"}}}
+	usage := estimateUsage(req, "ok")
+	mock.ExpectExec("INSERT INTO ai_usage").
+		WithArgs(int64(1), int64(7), "{7}", opRerank, "m", usage.PromptTokens, usage.CompletionTokens,
+			float64(usage.PromptTokens+2*usage.CompletionTokens)/1e6).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, err = ai.CreateChatCompletion(ctx, req)
+	assert.NoError(t, err)
+
+	// A stream is recorded once, with the usage the provider reports.
+	stub.stream = &staticStream{deltas: []string{"a", "b"}, usage: &go_openai.Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500}}
+	mock.ExpectExec("INSERT INTO ai_usage").
+		WithArgs(int64(1), nil, "{}", opAnswer, "other-model", 1000, 500, 0.0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	stream, err := ai.CreateChatCompletionStream(withUsage(context.WithValue(context.Background(), utils.UserIDKey, int64(1)), 0, opAnswer),
+		go_openai.ChatCompletionRequest{Model: "other-model"})
+	assert.NoError(t, err)
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		}
+	}
+	assert.NoError(t, stream.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordUsageAcrossKBs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// The answer is attributed to no KB but counts against both.
+	mock.ExpectExec("INSERT INTO ai_usage").
+		WithArgs(int64(1), nil, "{7,8}", opAnswer, "m", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	ai := RecordUsage(db, &chatStubAI{reply: "ok"}, nil)
+	ctx := context.WithValue(context.Background(), utils.UserIDKey, int64(1))
+	ctx = withAnswerUsage(ctx, []kbSettings{{ID: 7}, {ID: 8}}, opAnswer)
+	_, err = ai.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// modelStubAI answers chats as chatStubAI, reporting model as the model used.
+type modelStubAI struct {
+	chatStubAI
+	model string
+}
+
+func (m *modelStubAI) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	resp, err := m.chatStubAI.CreateChatCompletion(ctx, req)
+	resp.Model = m.model
+	return resp, err
+}
+
+func TestRecordUsageOfModelUsed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// The client failed over to another model, which is recorded and priced
+	// instead of the requested one.
+	mock.ExpectExec("INSERT INTO ai_usage").
+		WithArgs(int64(1), int64(7), "{7}", opAnswer, "fallback", sqlmock.AnyArg(), sqlmock.AnyArg(), 0.0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	ai := RecordUsage(db, &modelStubAI{chatStubAI: chatStubAI{reply: "ok"}, model: "fallback"}, map[string]ModelPrice{"m": {Input: 1, Output: 2}})
+	ctx := context.WithValue(context.Background(), utils.UserIDKey, int64(1))
+	_, err = ai.CreateChatCompletion(withUsage(ctx, 7, opAnswer), go_openai.ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsageRecorderCost(t *testing.T) {
+	u := &usageRecorder{prices: map[string]ModelPrice{go_openai.GPT4oMini: {Input: 1, Output: 1}}}
+	assert.InDelta(t, 2.0, u.cost(go_openai.GPT4oMini, 1e6, 1e6), 1e-9, "configured prices override the defaults")
+	assert.InDelta(t, 2.0, u.cost(go_openai.GPT4oMini+"-2024-07-18", 1e6, 1e6), 1e-9, "snapshots cost as much as their model")
+	assert.InDelta(t, 0.1, u.cost(string(go_openai.AdaEmbeddingV2), 1e6, 0), 1e-9)
+	assert.Zero(t, u.cost("unknown", 1e6, 1e6))
+}
+
+func TestUsage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer db.Close()
+
+	// An answer across KBs 7 and 8 is reported under both, but counted once
+	// in the total.
+	mock.ExpectQuery("FROM ai_usage WHERE user_id").WithArgs(int64(1), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "prompt", "completion", "cost"}).AddRow(3, 110, 20, 1.75))
+	mock.ExpectQuery(`unnest\(COALESCE\(NULLIF\(u.kb_ids`).WithArgs(int64(1), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"day", "kb_id", "name", "count", "prompt", "completion", "cost"}).
+			AddRow("2024-05-01", nil, "", 1, 10, 0, 0.5).
+			AddRow("2024-05-01", 7, "Docs", 2, 100, 20, 1.25).
+			AddRow("2024-05-01", 8, "FAQ", 1, 60, 10, 0.75))
+
+	h := NewKBHandler(db, nil)
+	w := httptest.NewRecorder()
+	req := conversationRequest(http.MethodGet, "", nil)
+	req.URL.RawQuery = "from=2024-05-01&to=2024-05-02"
+	h.Usage(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp usageResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "2024-05-01", resp.From)
+	assert.Len(t, resp.Days, 3)
+	assert.Nil(t, resp.Days[0].KBID)
+	assert.Equal(t, int64(7), *resp.Days[1].KBID)
+	assert.Equal(t, int64(8), *resp.Days[2].KBID)
+	assert.Equal(t, usageTotals{Calls: 3, PromptTokens: 110, CompletionTokens: 20, CostUSD: 1.75}, resp.Total)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsageInvalidDates(t *testing.T) {
+	h := NewKBHandler(nil, nil)
+	for _, query := range []string{"from=yesterday", "to=2024-13-01", "from=2024-05-02&to=2024-05-01"} {
+		w := httptest.NewRecorder()
+		req := conversationRequest(http.MethodGet, "", nil)
+		req.URL.RawQuery = query
+		h.Usage(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
@@ -0,0 +1,119 @@
+// Package llm builds the AI clients answering chat and embedding requests
+// from the configured providers.
+package llm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+	"github.com/zkiss/kb-codex/internal/config"
+)
+
+// New returns the ai.Client for cfg. Chat and embedding requests are sent to
+// their own providers when these differ, each retried and guarded by its own
+// circuit breaker. Chat fails over to the fallback provider, if configured.
+func New(cfg *config.Config) (ai.Client, error) {
+	opts := resilienceOptions(cfg)
+	chat, err := NewProvider(cfg.ChatProvider)
+	if err != nil {
+		return nil, fmt.Errorf("chat provider: %w", err)
+	}
+	embeddings := chat
+	if !reflect.DeepEqual(cfg.ChatProvider, cfg.EmbeddingProvider) {
+		if embeddings, err = NewProvider(cfg.EmbeddingProvider); err != nil {
+			return nil, fmt.Errorf("embedding provider: %w", err)
+		}
+	}
+	chat = Resilient("chat", chat, opts)
+	if cfg.FallbackChatProvider.Kind != "" {
+		fallback, err := NewProvider(cfg.FallbackChatProvider)
+		if err != nil {
+			return nil, fmt.Errorf("fallback chat provider: %w", err)
+		}
+		if cfg.FallbackChatModel != "" {
+			fallback = modelClient{Client: fallback, model: cfg.FallbackChatModel}
+		}
+		chat = Failover("chat", chat, Resilient("fallback_chat", fallback, opts))
+	}
+	return Split(chat, Resilient("embeddings", embeddings, opts)), nil
+}
+
+// resilienceOptions returns the retry and circuit breaker settings of cfg.
+// AI_MAX_RETRIES=0 disables retries, whereas the zero MaxRetries of
+// ResilienceOptions selects the default.
+func resilienceOptions(cfg *config.Config) ResilienceOptions {
+	maxRetries := cfg.AIMaxRetries
+	if maxRetries == 0 {
+		maxRetries = -1
+	}
+	return ResilienceOptions{
+		MaxRetries:       maxRetries,
+		RetryDelay:       cfg.AIRetryDelay,
+		MaxRetryDelay:    cfg.AIMaxRetryDelay,
+		FailureThreshold: cfg.AICircuitThreshold,
+		Cooldown:         cfg.AICircuitCooldown,
+	}
+}
+
+// NewProvider returns an ai.Client talking to a single provider.
+func NewProvider(p config.ProviderConfig) (ai.Client, error) {
+	var c go_openai.ClientConfig
+	switch p.Kind {
+	case config.ProviderOpenAI:
+		c = go_openai.DefaultConfig(p.APIKey)
+	case config.ProviderAzure:
+		c = go_openai.DefaultAzureConfig(p.APIKey, p.BaseURL)
+		if p.APIVersion != "" {
+			c.APIVersion = p.APIVersion
+		}
+		c.AzureModelMapperFunc = func(model string) string {
+			if deployment, ok := p.Deployments[model]; ok {
+				return deployment
+			}
+			return model
+		}
+	case config.ProviderLocal:
+		return NewLocal(p.Dimensions), nil
+	case config.ProviderOpenAICompatible:
+		// Local servers usually accept any key, but go-openai always sends
+		// the Authorization header.
+		c = go_openai.DefaultConfig(p.APIKey)
+		c.BaseURL = p.BaseURL
+	default:
+		return nil, fmt.Errorf("unknown provider %q", p.Kind)
+	}
+	c.HTTPClient = retryAfterDoer{next: c.HTTPClient}
+	return ai.NewOpenAIClient(go_openai.NewClientWithConfig(c)), nil
+}
+
+// splitClient sends chat requests to one client and embedding requests to
+// another.
+type splitClient struct {
+	chat       ai.Client
+	embeddings ai.Client
+}
+
+// Split returns an ai.Client using chat for chat completions and embeddings
+// for embeddings.
+func Split(chat, embeddings ai.Client) ai.Client {
+	return splitClient{chat: chat, embeddings: embeddings}
+}
+
+// CreateEmbeddings implements ai.Client.
+func (c splitClient) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	return c.embeddings.CreateEmbeddings(ctx, req)
+}
+
+// CreateChatCompletion implements ai.Client.
+func (c splitClient) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	return c.chat.CreateChatCompletion(ctx, req)
+}
+
+// CreateChatCompletionStream implements ai.Client.
+func (c splitClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	return c.chat.CreateChatCompletionStream(ctx, req)
+}
@@ -0,0 +1,119 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zkiss/kb-codex/internal/config"
+)
+
+// fakeServer answers embedding and chat requests and records the URL of the
+// last one.
+func fakeServer(t *testing.T, lastURL *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*lastURL = r.URL.String()
+		w.Header().Set("Content-Type", "application/json")
+		var resp any = go_openai.ChatCompletionResponse{
+			Choices: []go_openai.ChatCompletionChoice{{Message: go_openai.ChatCompletionMessage{Content: "hi"}}},
+		}
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			resp = go_openai.EmbeddingResponse{Data: []go_openai.Embedding{{Embedding: []float32{1, 0}}}}
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestOpenAICompatibleProvider(t *testing.T) {
+	var url string
+	srv := fakeServer(t, &url)
+	defer srv.Close()
+
+	c, err := NewProvider(config.ProviderConfig{Kind: config.ProviderOpenAICompatible, BaseURL: srv.URL + "/v1"})
+	assert.NoError(t, err)
+	resp, err := c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{Input: []string{"x"}, Model: "nomic-embed-text"})
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{1, 0}, resp.Data[0].Embedding)
+	assert.Equal(t, "/v1/embeddings", url)
+}
+
+func TestAzureProvider(t *testing.T) {
+	var url string
+	srv := fakeServer(t, &url)
+	defer srv.Close()
+
+	c, err := NewProvider(config.ProviderConfig{
+		Kind:        config.ProviderAzure,
+		APIKey:      "key",
+		BaseURL:     srv.URL,
+		APIVersion:  "2024-06-01",
+		Deployments: map[string]string{"gpt-4o-mini": "mini"},
+	})
+	assert.NoError(t, err)
+
+	_, err = c.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{Model: "gpt-4o-mini"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/openai/deployments/mini/chat/completions?api-version=2024-06-01", url)
+
+	_, err = c.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{Model: "gpt-4o"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/openai/deployments/gpt-4o/chat/completions?api-version=2024-06-01", url, "unmapped models use their own name")
+}
+
+func TestNewSplitsProviders(t *testing.T) {
+	var chatURL, embURL string
+	chatSrv := fakeServer(t, &chatURL)
+	defer chatSrv.Close()
+	embSrv := fakeServer(t, &embURL)
+	defer embSrv.Close()
+
+	c, err := New(&config.Config{
+		ChatProvider:      config.ProviderConfig{Kind: config.ProviderOpenAICompatible, BaseURL: chatSrv.URL},
+		EmbeddingProvider: config.ProviderConfig{Kind: config.ProviderOpenAICompatible, BaseURL: embSrv.URL},
+	})
+	assert.NoError(t, err)
+
+	_, err = c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{Input: []string{"x"}})
+	assert.NoError(t, err)
+	_, err = c.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "/embeddings", embURL)
+	assert.Equal(t, "/chat/completions", chatURL)
+}
+
+func TestNewProviderUnknown(t *testing.T) {
+	_, err := NewProvider(config.ProviderConfig{Kind: "bedrock"})
+	assert.Error(t, err)
+}
+
+func TestNewWithoutRetries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	provider := config.ProviderConfig{Kind: config.ProviderOpenAICompatible, BaseURL: srv.URL}
+	c, err := New(&config.Config{ChatProvider: provider, EmbeddingProvider: provider, AIMaxRetries: 0})
+	assert.NoError(t, err)
+	_, err = c.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "AI_MAX_RETRIES=0 makes a single attempt")
+
+	calls = 0
+	c, err = New(&config.Config{ChatProvider: provider, EmbeddingProvider: provider, AIMaxRetries: 1, AIRetryDelay: time.Millisecond})
+	assert.NoError(t, err)
+	_, err = c.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,294 @@
+package llm
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+	"github.com/zkiss/kb-codex/internal/utils"
+)
+
+const (
+	// localAnswerSentences is the number of context sentences an extractive
+	// answer is made of.
+	localAnswerSentences = 3
+	// localNoAnswer is the reply when no context sentence matches the question.
+	localNoAnswer = "I could not find an answer in the provided context."
+	// trigramWeight weighs the character trigrams of a term against the term
+	// itself, so that inflected forms of a word still match.
+	trigramWeight = 0.5
+	// claimSupport is the share of a claim's terms a single passage must
+	// contain to support it.
+	claimSupport = 0.6
+)
+
+// citationMarker matches citations such as [1] or [1, 2].
+var citationMarker = regexp.MustCompile(`\[[\d,\s]+\]`)
+
+// localClient is an ai.Client that works without a network: embeddings hash
+// the terms of the text into a fixed number of dimensions and chat replies
+// are extracted from the request's inputs. The results are deterministic.
+type localClient struct {
+	dimensions int
+}
+
+// NewLocal returns the offline AIClient producing embeddings of the given
+// size.
+func NewLocal(dimensions int) ai.Client {
+	return localClient{dimensions: dimensions}
+}
+
+// CreateEmbeddings implements ai.Client.
+func (c localClient) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	conv := req.Convert()
+	var inputs []string
+	switch in := conv.Input.(type) {
+	case string:
+		inputs = []string{in}
+	case []string:
+		inputs = in
+	default:
+		return go_openai.EmbeddingResponse{}, fmt.Errorf("local embeddings need text input, got %T", conv.Input)
+	}
+	resp := go_openai.EmbeddingResponse{Object: "list", Model: go_openai.EmbeddingModel(conv.Model)}
+	for i, text := range inputs {
+		resp.Data = append(resp.Data, go_openai.Embedding{Object: "embedding", Index: i, Embedding: c.embed(text)})
+		resp.Usage.PromptTokens += utils.CountTokens(text)
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	return resp, nil
+}
+
+// embed hashes every term of text and its character trigrams into a vector
+// of c.dimensions, with a hashed sign so that collisions cancel out rather
+// than add up, and normalises it. Texts sharing terms are therefore close.
+func (c localClient) embed(text string) []float32 {
+	vec := make([]float64, c.dimensions)
+	add := func(feature string, weight float64) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vec[sum%uint64(c.dimensions)] += weight
+	}
+	for _, term := range utils.Tokenize(text) {
+		add(term, 1)
+		padded := []rune("^" + term + "$")
+		for i := 0; i+3 <= len(padded); i++ {
+			add(string(padded[i:i+3]), trigramWeight)
+		}
+	}
+
+	var norm float64
+	for _, v := range vec {
+		norm += v * v
+	}
+	out := make([]float32, c.dimensions)
+	if norm == 0 {
+		// A zero vector has no cosine distance to anything.
+		out[0] = 1
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i, v := range vec {
+		out[i] = float32(v / norm)
+	}
+	return out
+}
+
+// CreateChatCompletion implements ai.Client.
+func (c localClient) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	reply := localReply(ctx, req.Messages)
+	return go_openai.ChatCompletionResponse{
+		Object: "chat.completion",
+		Model:  req.Model,
+		Choices: []go_openai.ChatCompletionChoice{{
+			Message:      go_openai.ChatCompletionMessage{Role: "assistant", Content: reply},
+			FinishReason: go_openai.FinishReasonStop,
+		}},
+		Usage: localUsage(req.Messages, reply),
+	}, nil
+}
+
+// CreateChatCompletionStream implements ai.Client. The reply is
+// streamed word by word.
+func (c localClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	reply := localReply(ctx, req.Messages)
+	s := &localStream{}
+	for _, word := range strings.SplitAfter(reply, " ") {
+		s.responses = append(s.responses, go_openai.ChatCompletionStreamResponse{
+			Model:   req.Model,
+			Choices: []go_openai.ChatCompletionStreamChoice{{Delta: go_openai.ChatCompletionStreamChoiceDelta{Content: word}}},
+		})
+	}
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		usage := localUsage(req.Messages, reply)
+		s.responses = append(s.responses, go_openai.ChatCompletionStreamResponse{Model: req.Model, Usage: &usage})
+	}
+	return s, nil
+}
+
+// localStream replays prepared stream responses.
+type localStream struct {
+	responses []go_openai.ChatCompletionStreamResponse
+}
+
+func (s *localStream) Recv() (go_openai.ChatCompletionStreamResponse, error) {
+	if len(s.responses) == 0 {
+		return go_openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp, nil
+}
+
+func (s *localStream) Close() error {
+	return nil
+}
+
+func localUsage(messages []go_openai.ChatCompletionMessage, reply string) go_openai.Usage {
+	var u go_openai.Usage
+	for _, m := range messages {
+		u.PromptTokens += utils.CountTokens(m.Content)
+	}
+	u.CompletionTokens = utils.CountTokens(reply)
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// localReply answers a chat request by the operation it is made for, taken
+// from ctx with its inputs: answers are the passage sentences best matching
+// the question, reranking scores passages and the grounding check gets
+// verdicts on claims. Any other request, such as a document to summarise or
+// a question to rewrite, is answered with the leading sentences of the last
+// user message. The prompt itself is never parsed.
+func localReply(ctx context.Context, messages []go_openai.ChatCompletionMessage) string {
+	in := ai.InputsOf(ctx)
+	switch ai.OperationOf(ctx) {
+	case ai.OpAnswer:
+		return extractAnswer(in.Question, in.Passages)
+	case ai.OpRerank:
+		return scorePassages(in.Question, in.Passages)
+	case ai.OpVerify:
+		return judgeClaims(in.Passages, in.Claims)
+	}
+	var prompt string
+	for _, m := range messages {
+		if m.Role == go_openai.ChatMessageRoleUser {
+			prompt = m.Content
+		}
+	}
+	return strings.Join(leadingSentences(prompt, localAnswerSentences), " ")
+}
+
+// scorePassages rates passages from 0 to 10 by their BM25 score for the
+// question, as a JSON array of one number per passage.
+func scorePassages(question string, passages []string) string {
+	docs := make([][]string, len(passages))
+	for i, p := range passages {
+		docs[i] = utils.Tokenize(p)
+	}
+	bm25 := utils.BM25Scores(utils.Tokenize(question), docs)
+	best := slices.Max(append(bm25, 0))
+	scores := make([]float64, len(passages))
+	for i := range scores {
+		if best > 0 {
+			scores[i] = math.Round(10 * bm25[i] / best)
+		}
+	}
+	out, _ := json.Marshal(scores)
+	return string(out)
+}
+
+// judgeClaims returns the verdicts on claims as a JSON array: 1 when a single
+// passage contains most of the claim's terms, 0 otherwise.
+func judgeClaims(passages, claims []string) string {
+	passageTerms := make([]map[string]bool, len(passages))
+	for i, p := range passages {
+		passageTerms[i] = map[string]bool{}
+		for _, t := range utils.Tokenize(p) {
+			passageTerms[i][t] = true
+		}
+	}
+	verdicts := make([]int, len(claims))
+	for i, claim := range claims {
+		terms := utils.Tokenize(citationMarker.ReplaceAllString(claim, " "))
+		for _, pt := range passageTerms {
+			found := 0
+			for _, t := range terms {
+				if pt[t] {
+					found++
+				}
+			}
+			if len(terms) > 0 && float64(found) >= claimSupport*float64(len(terms)) {
+				verdicts[i] = 1
+				break
+			}
+		}
+	}
+	out, _ := json.Marshal(verdicts)
+	return string(out)
+}
+
+// extractAnswer answers with the localAnswerSentences passage sentences
+// scoring best for the question, in passage order, each citing its passage
+// by its number.
+func extractAnswer(question string, passages []string) string {
+	type sentence struct {
+		text   string
+		marker int
+		score  float64
+		order  int
+	}
+	var sentences []sentence
+	var docs [][]string
+	for i, p := range passages {
+		for _, s := range leadingSentences(p, -1) {
+			sentences = append(sentences, sentence{text: s, marker: i + 1, order: len(sentences)})
+			docs = append(docs, utils.Tokenize(s))
+		}
+	}
+	for i, score := range utils.BM25Scores(utils.Tokenize(question), docs) {
+		sentences[i].score = score
+	}
+
+	slices.SortStableFunc(sentences, func(a, b sentence) int { return cmp.Compare(b.score, a.score) })
+	var picked []sentence
+	for _, s := range sentences {
+		if s.score <= 0 || len(picked) == localAnswerSentences {
+			break
+		}
+		picked = append(picked, s)
+	}
+	if len(picked) == 0 {
+		return localNoAnswer
+	}
+	slices.SortFunc(picked, func(a, b sentence) int { return a.order - b.order })
+	parts := make([]string, len(picked))
+	for i, s := range picked {
+		parts[i] = fmt.Sprintf("%s [%d]", strings.TrimRight(s.text, ".!? "), s.marker) + "."
+	}
+	return strings.Join(parts, " ")
+}
+
+// leadingSentences returns the first n sentences of text, or all of them
+// when n is negative.
+func leadingSentences(text string, n int) []string {
+	sentences := utils.Sentences(text)
+	if n >= 0 && len(sentences) > n {
+		sentences = sentences[:n]
+	}
+	return sentences
+}
@@ -0,0 +1,128 @@
+package llm
+
+import (
+	"context"
+	"io"
+	"math"
+	"testing"
+
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+)
+
+func cosine(a, b []float32) float64 {
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
+
+func TestLocalEmbeddings(t *testing.T) {
+	c := NewLocal(64)
+	resp, err := c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{
+		Input: []string{"How do I reset my password?", "Resetting a password", "The weather in Lisbon is sunny", ""},
+	})
+	assert.NoError(t, err)
+	if !assert.Len(t, resp.Data, 4) {
+		return
+	}
+	question, related, unrelated := resp.Data[0].Embedding, resp.Data[1].Embedding, resp.Data[2].Embedding
+	assert.Len(t, question, 64)
+	assert.InDelta(t, 1, cosine(question, question), 1e-6, "vectors are normalised")
+	assert.Greater(t, cosine(question, related), cosine(question, unrelated))
+	assert.False(t, math.IsNaN(cosine(resp.Data[3].Embedding, question)), "empty text has a direction")
+
+	again, _ := c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{Input: []string{"How do I reset my password?"}})
+	assert.Equal(t, question, again.Data[0].Embedding, "embeddings are deterministic")
+}
+
+func TestLocalAnswerIsExtractive(t *testing.T) {
+	ctx := ai.WithInputs(ai.WithOperation(context.Background(), ai.OpAnswer), ai.Inputs{
+		Question: "How do I reset my password?",
+		Passages: []string{"Passwords are reset from the account page. Support answers within a day.", "The office is closed on Sundays."},
+	})
+	// The reply depends on the inputs, not on how a custom template words the
+	// prompt.
+	resp, err := NewLocal(8).CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Messages: []go_openai.ChatCompletionMessage{
+			{Role: "system", Content: "You are a helpful assistant."},
+			{Role: "user", Content: "Reply in one line.\n\nPASSAGES\n...\n\nQ: How do I reset my password?"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Passwords are reset from the account page [1].", resp.Choices[0].Message.Content)
+	assert.Positive(t, resp.Usage.PromptTokens)
+
+	ctx = ai.WithInputs(ai.WithOperation(context.Background(), ai.OpAnswer), ai.Inputs{
+		Question: "Who won the match?",
+		Passages: []string{"The office is closed on Sundays."},
+	})
+	resp, _ = NewLocal(8).CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Messages: []go_openai.ChatCompletionMessage{{Role: "user", Content: "Who won the match?"}},
+	})
+	assert.Equal(t, localNoAnswer, resp.Choices[0].Message.Content)
+}
+
+func TestLocalScoresPassages(t *testing.T) {
+	ctx := ai.WithInputs(ai.WithOperation(context.Background(), ai.OpRerank), ai.Inputs{
+		Question: "reset password",
+		Passages: []string{"The office is closed.", "Reset the password on the account page."},
+	})
+	resp, err := NewLocal(8).CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Messages: []go_openai.ChatCompletionMessage{{Role: "user", Content: "Score the passages."}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "[0,10]", resp.Choices[0].Message.Content)
+}
+
+func TestLocalJudgesClaims(t *testing.T) {
+	ctx := ai.WithInputs(ai.WithOperation(context.Background(), ai.OpVerify), ai.Inputs{
+		Passages: []string{"Passwords are reset from the account settings page.", "Invoices are emailed on the first day of each month."},
+		Claims:   []string{"Passwords are reset from the account settings page [1].", "Refunds take ten business days [2]."},
+	})
+	resp, err := NewLocal(8).CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{
+		Messages: []go_openai.ChatCompletionMessage{{Role: "user", Content: "Judge the claims."}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "[1,0]", resp.Choices[0].Message.Content, "verdicts, not passage scores")
+}
+
+func TestLocalRewriteKeepsQuestion(t *testing.T) {
+	resp, _ := NewLocal(8).CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{
+		Messages: []go_openai.ChatCompletionMessage{
+			{Role: "system", Content: "Rewrite the user's question to be a standalone question using the conversation history."},
+			{Role: "user", Content: "what is alpha?"},
+			{Role: "assistant", Content: "The first letter."},
+			{Role: "user", Content: "and beta?"},
+		},
+	})
+	assert.Equal(t, "and beta?", resp.Choices[0].Message.Content)
+}
+
+func TestLocalStream(t *testing.T) {
+	stream, err := NewLocal(8).CreateChatCompletionStream(context.Background(), go_openai.ChatCompletionRequest{
+		Messages:      []go_openai.ChatCompletionMessage{{Role: "user", Content: "Hello there. More text."}},
+		StreamOptions: &go_openai.StreamOptions{IncludeUsage: true},
+	})
+	assert.NoError(t, err)
+	var text string
+	var usage *go_openai.Usage
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		if len(resp.Choices) > 0 {
+			text += resp.Choices[0].Delta.Content
+		}
+		if resp.Usage != nil {
+			usage = resp.Usage
+		}
+	}
+	assert.Equal(t, "Hello there. More text.", text)
+	assert.NotNil(t, usage)
+}
@@ -0,0 +1,419 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+)
+
+// ErrCircuitOpen is returned without calling the provider while its circuit
+// is open after repeated failures.
+var ErrCircuitOpen = errors.New("AI provider unavailable: circuit open")
+
+// metrics publishes the counters and circuit state of every resilient client
+// under /debug/vars (admins only), keyed by the client's name.
+var metrics = expvar.NewMap("ai")
+
+// ResilienceOptions configures retries and the circuit breaker. Zero values
+// fall back to the defaults.
+type ResilienceOptions struct {
+	// MaxRetries is the number of retries after a failed attempt; a negative
+	// value disables retries.
+	MaxRetries int
+	// RetryDelay is the backoff before the first retry. It doubles with every
+	// further retry up to MaxRetryDelay, which also caps Retry-After.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// FailureThreshold consecutive failed attempts open the circuit, which
+	// rejects calls for Cooldown before letting a trial call through.
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+func (o ResilienceOptions) withDefaults() ResilienceOptions {
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = 500 * time.Millisecond
+	}
+	if o.MaxRetryDelay <= 0 {
+		o.MaxRetryDelay = 30 * time.Second
+	}
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 5
+	}
+	if o.Cooldown <= 0 {
+		o.Cooldown = 30 * time.Second
+	}
+	return o
+}
+
+// Circuit states as reported by the metrics.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// resilientClient retries transient failures of an ai.Client and stops
+// calling it while its circuit is open.
+type resilientClient struct {
+	next ai.Client
+	name string
+	opts ResilienceOptions
+
+	// sleep and now are replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+	now   func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// Resilient wraps next with retries and a circuit breaker. name identifies
+// the client in the metrics.
+func Resilient(name string, next ai.Client, opts ResilienceOptions) ai.Client {
+	c := &resilientClient{next: next, name: name, opts: opts.withDefaults(), sleep: sleep, now: time.Now}
+	metrics.Set(name+"_circuit", expvar.Func(func() any { return c.state() }))
+	return c
+}
+
+// CreateEmbeddings implements ai.Client.
+func (c *resilientClient) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	var resp go_openai.EmbeddingResponse
+	err := c.do(ctx, func(ctx context.Context) (err error) {
+		resp, err = c.next.CreateEmbeddings(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// CreateChatCompletion implements ai.Client.
+func (c *resilientClient) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	var resp go_openai.ChatCompletionResponse
+	err := c.do(ctx, func(ctx context.Context) (err error) {
+		resp, err = c.next.CreateChatCompletion(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// CreateChatCompletionStream implements ai.Client. Only opening the
+// stream is retried; a stream failing midway has already sent tokens.
+func (c *resilientClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	var stream ai.ChatStream
+	err := c.do(ctx, func(ctx context.Context) (err error) {
+		stream, err = c.next.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	return stream, err
+}
+
+// do runs call, retrying transient failures with exponential backoff.
+func (c *resilientClient) do(ctx context.Context, call func(ctx context.Context) error) error {
+	var lastErr error
+	metrics.Add(c.name+"_calls", 1)
+	for attempt := 0; ; attempt++ {
+		if !c.allow() {
+			if attempt > 0 {
+				// The circuit opened while retrying; report why.
+				return lastErr
+			}
+			metrics.Add(c.name+"_rejected", 1)
+			return ErrCircuitOpen
+		}
+		hintCtx, hint := withRetryHint(ctx)
+		err := call(hintCtx)
+		lastErr = err
+		if err == nil {
+			c.record(true)
+			return nil
+		}
+		if ctx.Err() != nil {
+			c.release()
+			return err
+		}
+		if !transient(ctx, err) {
+			// The provider answered; the request itself was refused.
+			c.record(true)
+			return err
+		}
+		c.record(false)
+		metrics.Add(c.name+"_failures", 1)
+		if attempt >= c.opts.MaxRetries {
+			return err
+		}
+		delay := c.backoff(attempt)
+		if hint.after > 0 {
+			if hint.after > c.opts.MaxRetryDelay {
+				return err
+			}
+			delay = hint.after
+		}
+		metrics.Add(c.name+"_retries", 1)
+		if c.sleep(ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before retry attempt+1: the exponential delay
+// with jitter, so that clients do not retry in lockstep.
+func (c *resilientClient) backoff(attempt int) time.Duration {
+	d := c.opts.RetryDelay << attempt
+	if d <= 0 || d > c.opts.MaxRetryDelay {
+		d = c.opts.MaxRetryDelay
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// allow reports whether a call may be made. Once the cooldown of an open
+// circuit is over a single trial call is let through.
+func (c *resilientClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openUntil.IsZero() {
+		return true
+	}
+	if c.trial || c.now().Before(c.openUntil) {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// record updates the circuit with the outcome of an attempt.
+func (c *resilientClient) record(ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+	if ok {
+		c.failures = 0
+		c.openUntil = time.Time{}
+		return
+	}
+	c.failures++
+	if c.failures >= c.opts.FailureThreshold {
+		if c.openUntil.IsZero() {
+			metrics.Add(c.name+"_circuit_opened", 1)
+		}
+		c.openUntil = c.now().Add(c.opts.Cooldown)
+	}
+}
+
+// release ends a trial call whose outcome says nothing about the provider,
+// e.g. because the caller cancelled it.
+func (c *resilientClient) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+// state returns the circuit state for the metrics.
+func (c *resilientClient) state() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.openUntil.IsZero():
+		return circuitClosed
+	case c.now().Before(c.openUntil):
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+// transient reports whether err is worth retrying: rate limiting, a server
+// error, or a connection failure that was not caused by ctx.
+func transient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if code := statusCode(err); code != 0 {
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// statusCode returns the HTTP status of a provider error, or 0.
+func statusCode(err error) int {
+	var apiErr *go_openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *go_openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryHint carries the Retry-After of a failed response from the HTTP layer
+// to the retry loop, since go-openai's errors do not keep response headers.
+type retryHint struct {
+	after time.Duration
+}
+
+type retryHintKey struct{}
+
+func withRetryHint(ctx context.Context) (context.Context, *retryHint) {
+	hint := &retryHint{}
+	return context.WithValue(ctx, retryHintKey{}, hint), hint
+}
+
+// recordRetryAfter stores the delay a provider asked for in ctx's hint.
+func recordRetryAfter(ctx context.Context, d time.Duration) {
+	if hint, ok := ctx.Value(retryHintKey{}).(*retryHint); ok {
+		hint.after = d
+	}
+}
+
+// retryAfterDoer records the Retry-After header of failed responses.
+type retryAfterDoer struct {
+	next go_openai.HTTPDoer
+}
+
+// Do implements go_openai.HTTPDoer.
+func (d retryAfterDoer) Do(req *http.Request) (*http.Response, error) {
+	resp, err := d.next.Do(req)
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			recordRetryAfter(req.Context(), after)
+		}
+	}
+	return resp, err
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP
+// date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// failoverClient sends chat requests to a secondary client when the primary
+// is unavailable. Embeddings never fail over: vectors of another model could
+// not be compared with the stored ones.
+type failoverClient struct {
+	primary   ai.Client
+	secondary ai.Client
+	name      string
+}
+
+// Failover returns an ai.Client answering chat requests with secondary when
+// primary fails with a transient error or an open circuit. name identifies
+// the client in the metrics.
+func Failover(name string, primary, secondary ai.Client) ai.Client {
+	return failoverClient{primary: primary, secondary: secondary, name: name}
+}
+
+// CreateEmbeddings implements ai.Client.
+func (c failoverClient) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	return c.primary.CreateEmbeddings(ctx, req)
+}
+
+// CreateChatCompletion implements ai.Client.
+func (c failoverClient) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	resp, err := c.primary.CreateChatCompletion(ctx, req)
+	if err != nil && c.failOver(ctx, err) {
+		return c.secondary.CreateChatCompletion(ctx, req)
+	}
+	return resp, err
+}
+
+// CreateChatCompletionStream implements ai.Client.
+func (c failoverClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	stream, err := c.primary.CreateChatCompletionStream(ctx, req)
+	if err != nil && c.failOver(ctx, err) {
+		return c.secondary.CreateChatCompletionStream(ctx, req)
+	}
+	return stream, err
+}
+
+func (c failoverClient) failOver(ctx context.Context, err error) bool {
+	if !errors.Is(err, ErrCircuitOpen) && !transient(ctx, err) {
+		return false
+	}
+	metrics.Add(c.name+"_failovers", 1)
+	return true
+}
+
+// modelClient replaces the model of chat requests, for a secondary provider
+// that does not serve the primary's models.
+type modelClient struct {
+	ai.Client
+	model string
+}
+
+// CreateChatCompletion implements ai.Client. The response names the model
+// used even when the provider does not report it, so that usage is recorded
+// under it.
+func (c modelClient) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	req.Model = c.model
+	resp, err := c.Client.CreateChatCompletion(ctx, req)
+	if err == nil && resp.Model == "" {
+		resp.Model = c.model
+	}
+	return resp, err
+}
+
+// CreateChatCompletionStream implements ai.Client.
+func (c modelClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	req.Model = c.model
+	stream, err := c.Client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return modelStream{ChatStream: stream, model: c.model}, nil
+}
+
+// modelStream names the model of a modelClient's stream in the responses
+// where the provider does not.
+type modelStream struct {
+	ai.ChatStream
+	model string
+}
+
+func (s modelStream) Recv() (go_openai.ChatCompletionStreamResponse, error) {
+	resp, err := s.ChatStream.Recv()
+	if err == nil && resp.Model == "" {
+		resp.Model = s.model
+	}
+	return resp, err
+}
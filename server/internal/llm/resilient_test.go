@@ -0,0 +1,208 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+)
+
+// fakeClient fails with the queued errors, then answers with reply.
+type fakeClient struct {
+	errs       []error
+	retryAfter time.Duration
+	reply      string
+	calls      int
+	lastModel  string
+}
+
+func (f *fakeClient) next(ctx context.Context) error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	if f.retryAfter > 0 {
+		recordRetryAfter(ctx, f.retryAfter)
+	}
+	return err
+}
+
+func (f *fakeClient) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	if err := f.next(ctx); err != nil {
+		return go_openai.EmbeddingResponse{}, err
+	}
+	return go_openai.EmbeddingResponse{Data: []go_openai.Embedding{{Embedding: []float32{1}}}}, nil
+}
+
+func (f *fakeClient) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	f.lastModel = req.Model
+	if err := f.next(ctx); err != nil {
+		return go_openai.ChatCompletionResponse{}, err
+	}
+	return go_openai.ChatCompletionResponse{Choices: []go_openai.ChatCompletionChoice{{Message: go_openai.ChatCompletionMessage{Content: f.reply}}}}, nil
+}
+
+func (f *fakeClient) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	return nil, f.next(ctx)
+}
+
+func status(code int) error {
+	return &go_openai.APIError{HTTPStatusCode: code, Message: http.StatusText(code)}
+}
+
+// testClient returns a resilient client whose sleeps are recorded instead of
+// waited for and whose clock is controlled by the returned pointer.
+func testClient(next ai.Client, opts ResilienceOptions) (*resilientClient, *[]time.Duration, *time.Time) {
+	c := Resilient("test", next, opts).(*resilientClient)
+	var slept []time.Duration
+	now := time.Unix(0, 0)
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	c.now = func() time.Time { return now }
+	return c, &slept, &now
+}
+
+func TestResilientRetriesTransientErrors(t *testing.T) {
+	fake := &fakeClient{errs: []error{status(http.StatusTooManyRequests), status(http.StatusBadGateway)}, reply: "ok"}
+	c, slept, _ := testClient(fake, ResilienceOptions{RetryDelay: 100 * time.Millisecond})
+
+	resp, err := c.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp.Choices[0].Message.Content)
+	assert.Equal(t, 3, fake.calls)
+	if assert.Len(t, *slept, 2) {
+		assert.InDelta(t, 75*time.Millisecond, (*slept)[0], float64(25*time.Millisecond), "first backoff is around RetryDelay")
+		assert.InDelta(t, 150*time.Millisecond, (*slept)[1], float64(50*time.Millisecond), "backoff doubles")
+	}
+}
+
+func TestResilientDoesNotRetryClientErrors(t *testing.T) {
+	fake := &fakeClient{errs: []error{status(http.StatusBadRequest)}}
+	c, slept, _ := testClient(fake, ResilienceOptions{})
+
+	_, err := c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, fake.calls)
+	assert.Empty(t, *slept)
+}
+
+func TestResilientHonoursRetryAfter(t *testing.T) {
+	fake := &fakeClient{errs: []error{status(http.StatusTooManyRequests)}, retryAfter: 2 * time.Second}
+	c, slept, _ := testClient(fake, ResilienceOptions{})
+
+	_, err := c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{2 * time.Second}, *slept)
+
+	fake = &fakeClient{errs: []error{status(http.StatusTooManyRequests)}, retryAfter: time.Hour}
+	c, slept, _ = testClient(fake, ResilienceOptions{})
+	_, err = c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{})
+	assert.Error(t, err, "a Retry-After beyond MaxRetryDelay is not waited for")
+	assert.Empty(t, *slept)
+}
+
+func TestResilientCircuitBreaker(t *testing.T) {
+	unavailable := status(http.StatusServiceUnavailable)
+	fake := &fakeClient{errs: []error{unavailable, unavailable, unavailable}}
+	c, _, now := testClient(fake, ResilienceOptions{MaxRetries: -1, FailureThreshold: 2, Cooldown: time.Minute})
+	ctx := context.Background()
+
+	_, err := c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.ErrorIs(t, err, unavailable)
+	_, err = c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.ErrorIs(t, err, unavailable)
+	assert.Equal(t, circuitOpen, c.state())
+
+	_, err = c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, fake.calls, "an open circuit does not call the provider")
+
+	// After the cooldown a failing trial call opens the circuit again...
+	*now = now.Add(time.Minute)
+	assert.Equal(t, circuitHalfOpen, c.state())
+	_, err = c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.ErrorIs(t, err, unavailable)
+	assert.Equal(t, circuitOpen, c.state())
+
+	// ...and a successful one closes it.
+	*now = now.Add(time.Minute)
+	_, err = c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, circuitClosed, c.state())
+}
+
+func TestResilientStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fake := &fakeClient{errs: []error{context.Canceled}}
+	c, slept, _ := testClient(fake, ResilienceOptions{FailureThreshold: 1})
+	cancel()
+
+	_, err := c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, *slept)
+	assert.Equal(t, circuitClosed, c.state(), "cancelled calls are not provider failures")
+}
+
+func TestFailover(t *testing.T) {
+	primary := &fakeClient{errs: []error{ErrCircuitOpen, status(http.StatusBadRequest)}}
+	secondary := &fakeClient{reply: "from secondary"}
+	c := Failover("test", primary, modelClient{Client: secondary, model: "llama3"})
+	ctx := context.Background()
+
+	resp, err := c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{Model: "gpt-4o-mini"})
+	assert.NoError(t, err)
+	assert.Equal(t, "from secondary", resp.Choices[0].Message.Content)
+	assert.Equal(t, "llama3", secondary.lastModel)
+	assert.Equal(t, "llama3", resp.Model, "the response names the fallback model")
+
+	_, err = c.CreateChatCompletion(ctx, go_openai.ChatCompletionRequest{})
+	assert.Error(t, err, "client errors do not fail over")
+	assert.Equal(t, 1, secondary.calls)
+}
+
+func TestFailoverKeepsEmbeddingsOnPrimary(t *testing.T) {
+	primary := &fakeClient{errs: []error{ErrCircuitOpen}}
+	secondary := &fakeClient{}
+	c := Failover("test", primary, secondary)
+
+	_, err := c.CreateEmbeddings(context.Background(), go_openai.EmbeddingRequest{})
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Zero(t, secondary.calls)
+}
+
+func TestRetryAfterFromResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	ctx, hint := withRetryHint(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, nil)
+	resp, err := retryAfterDoer{next: http.DefaultClient}.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 7*time.Second, hint.after)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("Mon, 01 Jan 2024 00:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+}
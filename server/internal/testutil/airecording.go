@@ -0,0 +1,192 @@
+package testutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	go_openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zkiss/kb-codex/internal/ai"
+)
+
+// RecordAIEnv names the environment variable that switches AIRecording from
+// replaying golden files to recording them from a real provider.
+const RecordAIEnv = "RECORD_AI"
+
+// ErrUnrecorded is returned for requests that have no golden file.
+var ErrUnrecorded = errors.New("AI request not recorded")
+
+// AIBackend is the provider an AIRecording records from. *go_openai.Client
+// satisfies it.
+type AIBackend interface {
+	CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error)
+	CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error)
+}
+
+// AIRecording answers embedding and chat requests from golden files in a
+// directory, one file per request named after a hash of the request. With
+// RECORD_AI=1 it forwards requests to Backend instead, by default OpenAI
+// using OPENAI_API_KEY, and writes the golden files. Unrecorded requests fail
+// the test.
+type AIRecording struct {
+	// Backend is recorded from; it defaults to the OpenAI API.
+	Backend AIBackend
+
+	t      testing.TB
+	dir    string
+	record bool
+}
+
+var _ ai.Client = (*AIRecording)(nil)
+
+// NewAIRecording returns an AIRecording keeping its golden files in dir,
+// usually below testdata.
+func NewAIRecording(t testing.TB, dir string) *AIRecording {
+	record := os.Getenv(RecordAIEnv)
+	return &AIRecording{t: t, dir: dir, record: record == "1" || strings.ToLower(record) == "true"}
+}
+
+// RequireAIRecording skips the test when its golden files in dir have not
+// been recorded yet and RECORD_AI is not set to record them.
+func RequireAIRecording(t *testing.T, dir string) {
+	t.Helper()
+	if NewAIRecording(t, dir).record {
+		return
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) == 0 {
+		t.Skipf("skipping: no AI golden files in %s; rerun with %s=1 and OPENAI_API_KEY to record them", dir, RecordAIEnv)
+	}
+}
+
+// goldenFile is the content of a golden file.
+type goldenFile[Req, Resp any] struct {
+	Request  Req  `json:"request"`
+	Response Resp `json:"response"`
+}
+
+// CreateEmbeddings implements ai.Client.
+func (r *AIRecording) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	conv := req.Convert()
+	return replay(r, "embeddings", conv, func(b AIBackend) (go_openai.EmbeddingResponse, error) {
+		return b.CreateEmbeddings(ctx, conv)
+	})
+}
+
+// CreateChatCompletion implements ai.Client.
+func (r *AIRecording) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	return replay(r, "chat", req, func(b AIBackend) (go_openai.ChatCompletionResponse, error) {
+		return b.CreateChatCompletion(ctx, req)
+	})
+}
+
+// CreateChatCompletionStream answers a streamed chat request from the golden
+// file of the same request without streaming, delivering the whole reply as
+// a single delta.
+func (r *AIRecording) CreateChatCompletionStream(ctx context.Context, req go_openai.ChatCompletionRequest) (ai.ChatStream, error) {
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	req.Stream = false
+	req.StreamOptions = nil
+	resp, err := r.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s := &RecordedStream{}
+	if len(resp.Choices) > 0 {
+		s.responses = append(s.responses, go_openai.ChatCompletionStreamResponse{
+			ID:    resp.ID,
+			Model: resp.Model,
+			Choices: []go_openai.ChatCompletionStreamChoice{{
+				Delta:        go_openai.ChatCompletionStreamChoiceDelta{Role: resp.Choices[0].Message.Role, Content: resp.Choices[0].Message.Content},
+				FinishReason: resp.Choices[0].FinishReason,
+			}},
+		})
+	}
+	if includeUsage {
+		usage := resp.Usage
+		s.responses = append(s.responses, go_openai.ChatCompletionStreamResponse{ID: resp.ID, Model: resp.Model, Usage: &usage})
+	}
+	return s, nil
+}
+
+// RecordedStream replays a recorded chat completion as a stream.
+type RecordedStream struct {
+	responses []go_openai.ChatCompletionStreamResponse
+}
+
+// Recv returns the next response, or io.EOF at the end of the stream.
+func (s *RecordedStream) Recv() (go_openai.ChatCompletionStreamResponse, error) {
+	if len(s.responses) == 0 {
+		return go_openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp, nil
+}
+
+// Close implements the stream interface.
+func (s *RecordedStream) Close() error {
+	return nil
+}
+
+// replay answers req from its golden file, or records the answer of call
+// when recording.
+func replay[Req, Resp any](r *AIRecording, kind string, req Req, call func(AIBackend) (Resp, error)) (Resp, error) {
+	var zero Resp
+	key, err := json.Marshal(req)
+	if err != nil {
+		return zero, err
+	}
+	sum := sha256.Sum256(append([]byte(kind+"\n"), key...))
+	path := filepath.Join(r.dir, kind+"-"+hex.EncodeToString(sum[:8])+".json")
+
+	if !r.record {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Errorf rather than Fatalf: handlers call this off the test
+			// goroutine.
+			r.t.Errorf("%s request has no golden file %s; rerun with %s=1 to record it:\n%s", kind, path, RecordAIEnv, key)
+			return zero, fmt.Errorf("%w: %s", ErrUnrecorded, path)
+		}
+		if err != nil {
+			return zero, err
+		}
+		var golden goldenFile[Req, Resp]
+		if err := json.Unmarshal(data, &golden); err != nil {
+			return zero, fmt.Errorf("golden file %s: %w", path, err)
+		}
+		return golden.Response, nil
+	}
+
+	if r.Backend == nil {
+		apiKey := os.Getenv("OPENAI_API_KEY")
+		if apiKey == "" {
+			r.t.Errorf("recording AI requests requires OPENAI_API_KEY")
+			return zero, ErrUnrecorded
+		}
+		r.Backend = ai.NewOpenAIClient(go_openai.NewClient(apiKey))
+	}
+	resp, err := call(r.Backend)
+	if err != nil {
+		return zero, err
+	}
+	data, err := json.MarshalIndent(goldenFile[Req, Resp]{Request: req, Response: resp}, "", "  ")
+	if err != nil {
+		return zero, err
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return zero, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return zero, err
+	}
+	return resp, nil
+}
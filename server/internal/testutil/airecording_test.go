@@ -0,0 +1,93 @@
+package testutil
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	go_openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoBackend answers chat requests with the last message and embeds every
+// input as its length.
+type echoBackend struct {
+	calls int
+}
+
+func (b *echoBackend) CreateEmbeddings(ctx context.Context, req go_openai.EmbeddingRequestConverter) (go_openai.EmbeddingResponse, error) {
+	b.calls++
+	var resp go_openai.EmbeddingResponse
+	for i, in := range req.Convert().Input.([]string) {
+		resp.Data = append(resp.Data, go_openai.Embedding{Index: i, Embedding: []float32{float32(len(in)), 0.5}})
+	}
+	return resp, nil
+}
+
+func (b *echoBackend) CreateChatCompletion(ctx context.Context, req go_openai.ChatCompletionRequest) (go_openai.ChatCompletionResponse, error) {
+	b.calls++
+	return go_openai.ChatCompletionResponse{
+		Choices: []go_openai.ChatCompletionChoice{{Message: go_openai.ChatCompletionMessage{Role: "assistant", Content: "echo: " + req.Messages[len(req.Messages)-1].Content}}},
+		Usage:   go_openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+	}, nil
+}
+
+// recordingTB captures the errors reported by an AIRecording.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, format)
+}
+
+func TestAIRecordingRecordsAndReplays(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	chat := go_openai.ChatCompletionRequest{Model: "m", Messages: []go_openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+	emb := go_openai.EmbeddingRequest{Model: "e", Input: []string{"abc"}}
+
+	t.Setenv(RecordAIEnv, "1")
+	backend := &echoBackend{}
+	rec := NewAIRecording(t, dir)
+	rec.Backend = backend
+	recorded, err := rec.CreateChatCompletion(ctx, chat)
+	assert.NoError(t, err)
+	_, err = rec.CreateEmbeddings(ctx, emb)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, backend.calls)
+
+	t.Setenv(RecordAIEnv, "")
+	replay := NewAIRecording(t, dir)
+	replayed, err := replay.CreateChatCompletion(ctx, chat)
+	assert.NoError(t, err)
+	assert.Equal(t, recorded, replayed)
+	vectors, err := replay.CreateEmbeddings(ctx, emb)
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{3, 0.5}, vectors.Data[0].Embedding)
+
+	// A streamed request replays the recording of the same request.
+	chat.Stream = true
+	chat.StreamOptions = &go_openai.StreamOptions{IncludeUsage: true}
+	stream, err := replay.CreateChatCompletionStream(ctx, chat)
+	assert.NoError(t, err)
+	first, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: hi", first.Choices[0].Delta.Content)
+	usage, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, usage.Usage.TotalTokens)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAIRecordingFailsOnUnrecordedRequest(t *testing.T) {
+	t.Setenv(RecordAIEnv, "")
+	tb := &recordingTB{TB: t}
+	replay := NewAIRecording(tb, t.TempDir())
+
+	_, err := replay.CreateChatCompletion(context.Background(), go_openai.ChatCompletionRequest{Model: "m"})
+	assert.ErrorIs(t, err, ErrUnrecorded)
+	assert.Len(t, tb.errors, 1)
+}
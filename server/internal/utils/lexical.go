@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "do": true, "does": true, "for": true, "from": true,
+	"how": true, "i": true, "in": true, "is": true, "it": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true,
+	"was": true, "what": true, "when": true, "where": true, "which": true,
+	"who": true, "why": true, "with": true, "you": true,
+}
+
+// Tokenize splits text into lowercase alphanumeric terms, dropping common
+// English stop words.
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := fields[:0]
+	for _, f := range fields {
+		if !stopWords[f] {
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// BM25Scores scores each tokenized document against the query terms using
+// Okapi BM25, treating docs as the whole corpus.
+func BM25Scores(query []string, docs [][]string) []float64 {
+	const k1, b = 1.2, 0.75
+	scores := make([]float64, len(docs))
+	if len(docs) == 0 || len(query) == 0 {
+		return scores
+	}
+	var totalLen int
+	docFreq := map[string]int{}
+	for _, d := range docs {
+		totalLen += len(d)
+		seen := map[string]bool{}
+		for _, t := range d {
+			if !seen[t] {
+				seen[t] = true
+				docFreq[t]++
+			}
+		}
+	}
+	avgLen := float64(totalLen) / float64(len(docs))
+	if avgLen == 0 {
+		return scores
+	}
+	n := float64(len(docs))
+	for i, d := range docs {
+		tf := map[string]int{}
+		for _, t := range d {
+			tf[t]++
+		}
+		for _, q := range query {
+			f := float64(tf[q])
+			if f == 0 {
+				continue
+			}
+			df := float64(docFreq[q])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			scores[i] += idf * f * (k1 + 1) / (f + k1*(1-b+b*float64(len(d))/avgLen))
+		}
+	}
+	return scores
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"restart", "api", "server", "v2"}, Tokenize("How do I restart the API-server (v2)?"))
+}
+
+func TestBM25Scores(t *testing.T) {
+	docs := [][]string{
+		Tokenize("deploying the web frontend"),
+		Tokenize("restart the database server after an outage"),
+		Tokenize("database backups run nightly"),
+	}
+	scores := BM25Scores(Tokenize("restart database"), docs)
+	assert.Equal(t, 0.0, scores[0])
+	assert.Greater(t, scores[1], scores[2])
+	assert.Greater(t, scores[2], 0.0)
+}
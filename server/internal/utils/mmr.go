@@ -0,0 +1,86 @@
+package utils
+
+import "math"
+
+// CosineSimilarity returns the cosine of the angle between a and b, or 0 when
+// either vector has zero length.
+func CosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		if i >= len(b) {
+			break
+		}
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// MMR selects up to k items by maximal marginal relevance and returns their
+// indices in selection order. Each step picks the item maximising
+//
+//	lambda*relevance[i] - (1-lambda)*max(similarity to already selected items)
+//
+// where similarity is the cosine between vectors. Relevance values are min-max
+// normalised first so that lambda balances comparable quantities; lambda 1
+// ranks purely by relevance and lambda 0 purely by novelty.
+func MMR(relevance []float64, vectors [][]float32, lambda float64, k int) []int {
+	n := len(relevance)
+	if k > n {
+		k = n
+	}
+	rel := normalize(relevance)
+	selected := make([]int, 0, k)
+	taken := make([]bool, n)
+	// maxSim[i] is the highest similarity of item i to any selected item.
+	maxSim := make([]float64, n)
+	for len(selected) < k {
+		best, bestScore := -1, math.Inf(-1)
+		for i := 0; i < n; i++ {
+			if taken[i] {
+				continue
+			}
+			score := lambda * rel[i]
+			if len(selected) > 0 {
+				score -= (1 - lambda) * maxSim[i]
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		taken[best] = true
+		selected = append(selected, best)
+		for i := 0; i < n; i++ {
+			if !taken[i] {
+				if s := CosineSimilarity(vectors[i], vectors[best]); s > maxSim[i] {
+					maxSim[i] = s
+				}
+			}
+		}
+	}
+	return selected
+}
+
+func normalize(values []float64) []float64 {
+	out := make([]float64, len(values))
+	if len(values) == 0 {
+		return out
+	}
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	for i, v := range values {
+		if hi > lo {
+			out[i] = (v - lo) / (hi - lo)
+		} else {
+			out[i] = 1
+		}
+	}
+	return out
+}
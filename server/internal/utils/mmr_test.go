@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCosineSimilarity(t *testing.T) {
+	assert.InDelta(t, 1.0, CosineSimilarity([]float32{1, 1}, []float32{2, 2}), 1e-9)
+	assert.InDelta(t, 0.0, CosineSimilarity([]float32{1, 0}, []float32{0, 1}), 1e-9)
+	assert.Equal(t, 0.0, CosineSimilarity([]float32{0, 0}, []float32{1, 0}))
+}
+
+func TestMMR(t *testing.T) {
+	// Items 0 and 1 are near duplicates; item 2 is less relevant but distinct.
+	relevance := []float64{0.9, 0.89, 0.7}
+	vectors := [][]float32{{1, 0}, {0.99, 0.01}, {0, 1}}
+
+	assert.Equal(t, []int{0, 1}, MMR(relevance, vectors, 1, 2))
+	assert.Equal(t, []int{0, 2}, MMR(relevance, vectors, 0.5, 2))
+	assert.Equal(t, []int{0, 2, 1}, MMR(relevance, vectors, 0.5, 5))
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseNumbers extracts the JSON array of n numbers from a model reply,
+// ignoring any text around it.
+func ParseNumbers(reply string, n int) ([]float64, error) {
+	start := strings.IndexByte(reply, '[')
+	end := strings.LastIndexByte(reply, ']')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON array in reply")
+	}
+	var numbers []float64
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &numbers); err != nil {
+		return nil, fmt.Errorf("invalid JSON array: %w", err)
+	}
+	if len(numbers) != n {
+		return nil, fmt.Errorf("got %d numbers, expected %d", len(numbers), n)
+	}
+	return numbers, nil
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNumbers(t *testing.T) {
+	numbers, err := ParseNumbers("Scores: [3, 0.5, 10]\n", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{3, 0.5, 10}, numbers)
+
+	_, err = ParseNumbers("no idea", 3)
+	assert.Error(t, err)
+	_, err = ParseNumbers("[1, two]", 2)
+	assert.Error(t, err)
+	_, err = ParseNumbers("[1, 2]", 3)
+	assert.Error(t, err)
+}
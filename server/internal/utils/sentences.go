@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sentencePattern matches a sentence with its closing punctuation; line
+// breaks end a sentence too.
+var sentencePattern = regexp.MustCompile(`[^.!?\n]+(?:[.!?]+|$|\n)`)
+
+// Sentences splits text into its non-empty sentences, trimmed of
+// surrounding whitespace.
+func Sentences(text string) []string {
+	var out []string
+	for _, s := range sentencePattern.FindAllString(text, -1) {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSentences(t *testing.T) {
+	assert.Equal(t, []string{"Yes.", "It works [1]!", "Really?", "See above"},
+		Sentences("Yes. It works [1]! Really?\n\nSee above"))
+	assert.Empty(t, Sentences(" \n "))
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Snippet shortens text to at most maxLen bytes, cutting on a word boundary and
+// marking the cut with an ellipsis. Whitespace runs are collapsed.
+func Snippet(text string, maxLen int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= maxLen {
+		return text
+	}
+	cut := strings.LastIndexByte(text[:maxLen+1], ' ')
+	if cut <= 0 {
+		cut = maxLen
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+	}
+	return strings.TrimRight(text[:cut], " ") + "…"
+}
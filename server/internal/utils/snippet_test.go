@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnippet(t *testing.T) {
+	assert.Equal(t, "short text", Snippet("short \n text", 20))
+	assert.Equal(t, "the quick brown…", Snippet("the quick brown fox jumps", 16))
+	assert.Equal(t, "abcdefgh…", Snippet("abcdefghijklmnop", 8))
+}
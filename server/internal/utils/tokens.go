@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// CountTokens estimates the number of model tokens in text without loading a
+// tokenizer vocabulary. It approximates BPE tokenizers such as cl100k: a run of
+// letters and digits costs one token per started seven characters, every other
+// non-space character costs one token, and whitespace is free because it is
+// merged into the following word.
+func CountTokens(text string) int {
+	tokens, run := 0, 0
+	flush := func() {
+		if run > 0 {
+			tokens += (run + 6) / 7
+			run = 0
+		}
+	}
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if r >= utf8.RuneSelf {
+				// Non-ASCII letters are usually split into several tokens.
+				run += 2
+			} else {
+				run++
+			}
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTokens(t *testing.T) {
+	assert.Equal(t, 0, CountTokens(""))
+	assert.Equal(t, 2, CountTokens("hello world"))
+	assert.Equal(t, 4, CountTokens("Hi, there!"))
+	assert.Equal(t, 3, CountTokens("internationalization"))
+}
@@ -0,0 +1,23 @@
+package utils
+
+import "strings"
+
+// TruncateTokens returns the longest prefix of text made of whole words whose
+// CountTokens estimate does not exceed maxTokens.
+func TruncateTokens(text string, maxTokens int) string {
+	if CountTokens(text) <= maxTokens {
+		return text
+	}
+	words := strings.Fields(text)
+	// Binary search for the number of words that still fits.
+	lo, hi := 0, len(words)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if CountTokens(strings.Join(words[:mid], " ")) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return strings.Join(words[:lo], " ")
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateTokens(t *testing.T) {
+	assert.Equal(t, "one two three", TruncateTokens("one two three", 3))
+	assert.Equal(t, "one two", TruncateTokens("one two three four", 2))
+	assert.Equal(t, "", TruncateTokens("one", 0))
+}
@@ -0,0 +1,17 @@
+-- Per-KB distance metric driving both the search operator and the index operator class.
+-- Existing KBs keep the L2 distance they were searched with; new KBs default to cosine.
+ALTER TABLE knowledge_bases ADD COLUMN distance_metric TEXT NOT NULL DEFAULT 'l2';
+ALTER TABLE knowledge_bases ALTER COLUMN distance_metric SET DEFAULT 'cosine';
+ALTER TABLE knowledge_bases ADD CONSTRAINT knowledge_bases_distance_metric_check
+    CHECK (distance_metric IN ('l2', 'cosine', 'inner_product'));
+
+-- One partial HNSW index per KB, since the operator class depends on the KB's metric
+DO $$
+DECLARE
+    kb RECORD;
+BEGIN
+    FOR kb IN SELECT id FROM knowledge_bases LOOP
+        EXECUTE format('CREATE INDEX IF NOT EXISTS chunks_kb_%s_embedding_idx ON chunks USING hnsw (embedding vector_l2_ops) WHERE kb_id = %s', kb.id, kb.id);
+    END LOOP;
+END
+$$;
@@ -0,0 +1,5 @@
+-- Store the file slug on each chunk so search results can link back to the file
+ALTER TABLE chunks ADD COLUMN lookup_name TEXT NOT NULL DEFAULT '';
+UPDATE chunks c SET lookup_name = f.lookup_name
+FROM files f
+WHERE f.kb_id = c.kb_id AND f.file_name = c.file_name;
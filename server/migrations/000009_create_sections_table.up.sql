@@ -0,0 +1,12 @@
+-- Parent sections of a file; chunks are the smaller children that get embedded
+CREATE TABLE IF NOT EXISTS sections (
+    id SERIAL PRIMARY KEY,
+    kb_id INTEGER NOT NULL REFERENCES knowledge_bases(id) ON DELETE CASCADE,
+    file_name TEXT NOT NULL,
+    lookup_name TEXT NOT NULL,
+    section_index INTEGER NOT NULL,
+    content TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sections_kb_id_lookup_name_idx ON sections(kb_id, lookup_name);
+
+ALTER TABLE chunks ADD COLUMN section_id INTEGER REFERENCES sections(id) ON DELETE CASCADE;
@@ -0,0 +1,10 @@
+-- One generated summary per file, embedded for document-level retrieval
+CREATE TABLE IF NOT EXISTS file_summaries (
+    kb_id INTEGER NOT NULL REFERENCES knowledge_bases(id) ON DELETE CASCADE,
+    lookup_name TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    summary TEXT NOT NULL,
+    embedding VECTOR(1536) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (kb_id, lookup_name)
+);
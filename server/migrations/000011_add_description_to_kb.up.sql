@@ -0,0 +1,3 @@
+-- KB descriptions and their embeddings are used to route questions to KBs
+ALTER TABLE knowledge_bases ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE knowledge_bases ADD COLUMN description_embedding VECTOR(1536);
@@ -0,0 +1,3 @@
+-- Per-KB answer style; empty values use the built-in prompt
+ALTER TABLE knowledge_bases ADD COLUMN system_prompt TEXT NOT NULL DEFAULT '';
+ALTER TABLE knowledge_bases ADD COLUMN prompt_template TEXT NOT NULL DEFAULT '';
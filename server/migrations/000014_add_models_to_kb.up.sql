@@ -0,0 +1,38 @@
+-- Per-KB chat and embedding models. Existing KBs keep the embedding model
+-- their vectors were created with.
+ALTER TABLE knowledge_bases ADD COLUMN chat_model TEXT NOT NULL DEFAULT '';
+ALTER TABLE knowledge_bases ADD COLUMN embedding_model TEXT NOT NULL DEFAULT 'text-embedding-ada-002';
+ALTER TABLE knowledge_bases ADD COLUMN embedding_dimensions INTEGER NOT NULL DEFAULT 1536;
+
+-- Vectors no longer share one size, so the columns become untyped and each
+-- KB's index casts the embedding to the KB's dimensions
+DO $$
+DECLARE
+    kb RECORD;
+BEGIN
+    FOR kb IN SELECT id FROM knowledge_bases LOOP
+        EXECUTE format('DROP INDEX IF EXISTS chunks_kb_%s_embedding_idx', kb.id);
+    END LOOP;
+END
+$$;
+
+ALTER TABLE chunks ALTER COLUMN embedding TYPE vector;
+ALTER TABLE file_summaries ALTER COLUMN embedding TYPE vector;
+ALTER TABLE knowledge_bases ALTER COLUMN description_embedding TYPE vector;
+
+DO $$
+DECLARE
+    kb RECORD;
+BEGIN
+    FOR kb IN SELECT id, distance_metric, embedding_dimensions FROM knowledge_bases LOOP
+        EXECUTE format('CREATE INDEX IF NOT EXISTS chunks_kb_%s_embedding_idx ON chunks USING hnsw ((embedding::vector(%s)) %s) WHERE kb_id = %s',
+            kb.id, kb.embedding_dimensions,
+            CASE kb.distance_metric
+                WHEN 'l2' THEN 'vector_l2_ops'
+                WHEN 'inner_product' THEN 'vector_ip_ops'
+                ELSE 'vector_cosine_ops'
+            END,
+            kb.id);
+    END LOOP;
+END
+$$;
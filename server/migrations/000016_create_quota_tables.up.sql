@@ -0,0 +1,29 @@
+-- Uploaded bytes count towards the monthly upload quota
+CREATE TABLE IF NOT EXISTS uploads (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    kb_id INTEGER REFERENCES knowledge_bases(id) ON DELETE SET NULL,
+    file_name TEXT NOT NULL,
+    bytes BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS uploads_user_id_idx ON uploads (user_id, created_at);
+CREATE INDEX IF NOT EXISTS uploads_kb_id_idx ON uploads (kb_id, created_at);
+CREATE INDEX IF NOT EXISTS ai_usage_kb_id_idx ON ai_usage (kb_id, created_at);
+
+-- Monthly limits set by admins; NULL falls back to the configured default
+-- for users and means no limit for KBs, 0 means unlimited
+CREATE TABLE IF NOT EXISTS user_limits (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    tokens BIGINT,
+    upload_bytes BIGINT,
+    questions BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS kb_limits (
+    kb_id INTEGER PRIMARY KEY REFERENCES knowledge_bases(id) ON DELETE CASCADE,
+    tokens BIGINT,
+    upload_bytes BIGINT,
+    questions BIGINT
+);
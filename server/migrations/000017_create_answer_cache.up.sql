@@ -0,0 +1,13 @@
+-- Bumped whenever the files of a KB change, invalidating its cached answers
+ALTER TABLE knowledge_bases ADD COLUMN IF NOT EXISTS content_version INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS answer_cache (
+    key TEXT PRIMARY KEY,
+    kb_ids INTEGER[] NOT NULL,
+    response JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS answer_cache_kb_ids_idx ON answer_cache USING GIN (kb_ids);
+CREATE INDEX IF NOT EXISTS answer_cache_expires_at_idx ON answer_cache (expires_at);
@@ -0,0 +1,31 @@
+-- Every answer given, so that users can rate it later; chunk_ids are the
+-- retrieved chunks the answer was based on
+CREATE TABLE IF NOT EXISTS answers (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    kb_ids INTEGER[] NOT NULL,
+    question TEXT NOT NULL,
+    answer TEXT NOT NULL,
+    chunk_ids INTEGER[] NOT NULL DEFAULT '{}',
+    citations JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS answers_kb_ids_idx ON answers USING GIN (kb_ids);
+
+-- A user's rating of an answer; helpful_citations are the citation markers
+-- of the answer the user found helpful
+CREATE TABLE IF NOT EXISTS answer_feedback (
+    id BIGSERIAL PRIMARY KEY,
+    answer_id BIGINT NOT NULL REFERENCES answers(id) ON DELETE CASCADE,
+    kb_id INTEGER NOT NULL REFERENCES knowledge_bases(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    rating TEXT NOT NULL CHECK (rating IN ('up', 'down')),
+    comment TEXT NOT NULL DEFAULT '',
+    helpful_citations INTEGER[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (answer_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS answer_feedback_kb_id_idx ON answer_feedback (kb_id, rating, updated_at DESC);
@@ -0,0 +1,6 @@
+-- The KBs an AI call counts against: the KB it is attributed to, or every KB
+-- of an answer across several KBs
+ALTER TABLE ai_usage ADD COLUMN IF NOT EXISTS kb_ids INTEGER[] NOT NULL DEFAULT '{}';
+UPDATE ai_usage SET kb_ids = ARRAY[kb_id] WHERE kb_id IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS ai_usage_kb_ids_idx ON ai_usage USING gin (kb_ids);